@@ -6,8 +6,12 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+
+	"github.com/f0reachARR/casljs/comet2"
 )
 
 // Test input configuration
@@ -103,3 +107,820 @@ func testSample(t *testing.T, casFile string, testInputs TestInput) {
 		}
 	}
 }
+
+func TestLoadObject(t *testing.T) {
+	casFile := "test/samples/program1/sample11.cas"
+	inputs := []string{"3", "1", "2", "3"}
+
+	direct, _ := exec.Command("./c2c2", append([]string{"-n", "-q", "-r", casFile}, inputs...)...).CombinedOutput()
+
+	objFile := filepath.Join(t.TempDir(), "sample11.obj")
+	if output, err := exec.Command("./c2c2", "-q", "-o", objFile, casFile).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to write object: %v\nOutput: %s", err, string(output))
+	}
+
+	loaded, _ := exec.Command("./c2c2", append([]string{"-n", "-q", "-r", "-l", objFile}, inputs...)...).CombinedOutput()
+	if string(loaded) != string(direct) {
+		t.Errorf("Output mismatch\nDirect:\n%s\nLoaded:\n%s", string(direct), string(loaded))
+	}
+
+	// A truncated object file must be rejected
+	data, err := ioutil.ReadFile(objFile)
+	if err != nil {
+		t.Fatalf("Failed to read object: %v", err)
+	}
+	if err := ioutil.WriteFile(objFile, data[:len(data)-1], 0644); err != nil {
+		t.Fatalf("Failed to truncate object: %v", err)
+	}
+	output, err := exec.Command("./c2c2", "-n", "-q", "-r", "-l", objFile).CombinedOutput()
+	if err == nil {
+		t.Errorf("Expected failure for truncated object, got output:\n%s", string(output))
+	}
+	if !strings.Contains(string(output), "truncated or corrupt") {
+		t.Errorf("Unexpected error output: %s", string(output))
+	}
+}
+
+// runMonitor assembles source with the c2c2 binary and feeds commands to the monitor
+func runMonitor(t *testing.T, source string, commands string, args ...string) string {
+	t.Helper()
+	casFile := writeSource(t, source)
+
+	cmd := exec.Command("./c2c2", append(append([]string{"-n", "-q"}, args...), casFile)...)
+	cmd.Stdin = strings.NewReader(commands)
+	output, _ := cmd.CombinedOutput()
+	return string(output)
+}
+
+// writeSource writes source to test.cas in a temporary directory and
+// returns its path
+func writeSource(t *testing.T, source string) string {
+	t.Helper()
+	casFile := filepath.Join(t.TempDir(), "test.cas")
+	if err := ioutil.WriteFile(casFile, []byte(source), 0644); err != nil {
+		t.Fatalf("Failed to write source: %v", err)
+	}
+	return casFile
+}
+
+// runC2C2 runs source with -n -Q and args, and returns the output and the
+// exit status
+func runC2C2(t *testing.T, source string, args ...string) (string, int) {
+	t.Helper()
+	casFile := writeSource(t, source)
+
+	output, err := exec.Command("./c2c2", append(append([]string{"-n", "-Q"}, args...), casFile)...).CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return string(output), exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatalf("Failed to run c2c2: %v", err)
+	}
+	return string(output), 0
+}
+
+const straightLineProgram = `MAIN	START
+	LAD	GR1, 1
+	LAD	GR2, 2
+	LAD	GR3, 3
+	RET
+	END
+`
+
+func TestMonitorBreakpoint(t *testing.T) {
+	output := runMonitor(t, straightLineProgram, "b #0004\ninfo break\nrun\nq\n")
+
+	if !strings.Contains(output, "1: #0004") {
+		t.Errorf("Breakpoint not listed:\n%s", output)
+	}
+	if !strings.Contains(output, "Breakpoint at #0004") {
+		t.Fatalf("Execution did not stop at breakpoint:\n%s", output)
+	}
+	if !strings.Contains(output, "GR2 #0002") || !strings.Contains(output, "GR3 #0000") {
+		t.Errorf("Unexpected registers at breakpoint:\n%s", output)
+	}
+	if strings.Contains(output, "Program finished") {
+		t.Errorf("Program ran past the breakpoint:\n%s", output)
+	}
+}
+
+func TestMonitorWatchpoint(t *testing.T) {
+	src := `MAIN	START
+	LAD	GR1, 5
+	ST	GR1, DATA
+	LAD	GR2, 1
+	RET
+DATA	DC	0
+	END
+`
+	output := runMonitor(t, src, "watch #0007\nrun\nq\n")
+
+	if !strings.Contains(output, "Watchpoint #1: #0007 changed 0 -> 5") {
+		t.Fatalf("Watchpoint did not trigger:\n%s", output)
+	}
+	if !strings.Contains(output, "PR  #0004") || !strings.Contains(output, "GR2 #0000") {
+		t.Errorf("Execution did not halt after the storing instruction:\n%s", output)
+	}
+}
+
+func TestStepLimit(t *testing.T) {
+	src := `MAIN	START
+	LAD	GR1, 1
+LOOP	JUMP	LOOP
+	END
+`
+	output := runMonitor(t, src, "", "-r", "-steps", "100")
+	if !strings.Contains(output, "Execution limit reached (100 steps) at #0002") {
+		t.Errorf("Step limit did not stop the loop:\n%s", output)
+	}
+}
+
+func TestMonitorReset(t *testing.T) {
+	src := `MAIN	START
+	LD	GR1, LEN
+	LAD	GR1, -1, GR1
+	ST	GR1, LEN
+	OUT	MSG, LEN
+	RET
+MSG	DC	'HELLO'
+LEN	DC	5
+	END
+`
+	output := runMonitor(t, src, "run\nreset\nrun\nq\n")
+
+	if n := strings.Count(output, "OUT> HELL\n"); n != 2 {
+		t.Errorf("Expected identical output from both runs, got %d matches:\n%s", n, output)
+	}
+	if n := strings.Count(output, "Program finished (RET)"); n != 2 {
+		t.Errorf("Expected the program to finish twice, got %d:\n%s", n, output)
+	}
+}
+
+func TestInputFile(t *testing.T) {
+	src := `MAIN	START
+	IN	BUF, LEN
+	OUT	BUF, LEN
+	IN	BUF, LEN
+	OUT	BUF, LEN
+	RET
+BUF	DS	16
+LEN	DS	1
+	END
+`
+	inputFile := filepath.Join(t.TempDir(), "input.txt")
+	if err := ioutil.WriteFile(inputFile, []byte("first\nsecond\n"), 0644); err != nil {
+		t.Fatalf("Failed to write input: %v", err)
+	}
+
+	output := runMonitor(t, src, "", "-r", "-i", inputFile)
+	if !strings.Contains(output, "OUT> first\n") || !strings.Contains(output, "OUT> second\n") {
+		t.Errorf("Inputs were not read from file:\n%s", output)
+	}
+	if !strings.Contains(output, "Program finished (RET)") {
+		t.Errorf("Program did not finish:\n%s", output)
+	}
+}
+
+func TestOutputFile(t *testing.T) {
+	src := `MAIN	START
+	OUT	MSG1, LEN1
+	OUT	MSG2, LEN2
+	RET
+MSG1	DC	'Hello'
+LEN1	DC	5
+MSG2	DC	'World'
+LEN2	DC	5
+	END
+`
+	outFile := filepath.Join(t.TempDir(), "out.txt")
+	output := runMonitor(t, src, "", "-r", "-O", outFile)
+
+	data, err := ioutil.ReadFile(outFile)
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+	if string(data) != "Hello\nWorld\n" {
+		t.Errorf("Output file = %q, want %q", string(data), "Hello\nWorld\n")
+	}
+	if strings.Contains(output, "OUT>") {
+		t.Errorf("OUT was also written to stdout:\n%s", output)
+	}
+	if !strings.Contains(output, "Program finished (RET)") {
+		t.Errorf("Monitor messages missing from stdout:\n%s", output)
+	}
+}
+
+func TestMonitorGoto(t *testing.T) {
+	output := runMonitor(t, straightLineProgram, "goto #0004\nq\n")
+
+	if !strings.Contains(output, "Reached #0004") || !strings.Contains(output, "PR  #0004") {
+		t.Fatalf("goto did not stop at #0004:\n%s", output)
+	}
+	if !strings.Contains(output, "GR2 #0002") || !strings.Contains(output, "GR3 #0000") {
+		t.Errorf("Unexpected registers after goto:\n%s", output)
+	}
+	if strings.Contains(output, "Program finished") {
+		t.Errorf("Program ran past the goto target:\n%s", output)
+	}
+}
+
+func TestMonitorBacktrace(t *testing.T) {
+	src := `MAIN	START
+	CALL	SUBA
+	RET
+	END
+SUBA	START
+	PUSH	5
+	CALL	SUBB
+	POP	GR1
+	RET
+	END
+SUBB	START
+	NOP
+	RET
+	END
+`
+	output := runMonitor(t, src, "goto #000a\nbt\nq\n")
+
+	for _, frame := range []string{"#0  #000a (line 13)", "#1  #0005 (line 7)", "#2  #0000 (line 2)"} {
+		if !strings.Contains(output, frame) {
+			t.Errorf("Frame %q missing from backtrace:\n%s", frame, output)
+		}
+	}
+	// The PUSHed word is not a return address
+	if strings.Contains(output, "#3") {
+		t.Errorf("Unexpected extra frame:\n%s", output)
+	}
+}
+
+func TestSVCExitStatus(t *testing.T) {
+	cases := []struct {
+		src  string
+		want int
+	}{
+		{"MAIN\tSTART\n\tSVC\t2\n\tEND\n", comet2.SVC_EXIT_STATUS + comet2.EXIT_DVZ},
+		{"MAIN\tSTART\n\tSVC\t0\n\tEND\n", comet2.SVC_EXIT_STATUS + comet2.EXIT_USR},
+		{"MAIN\tSTART\n\tRET\n\tEND\n", 0},
+		{"MAIN\tSTART\n\tCALL\tMAIN\n\tEND\n", comet2.STACK_EXIT_STATUS},
+		{"MAIN\tSTART\n\tPOP\tGR1\n\tEND\n", comet2.STACK_EXIT_STATUS},
+		// Division by zero ends the program like SVC 2 (DVZ)
+		{"MAIN\tSTART\n\tDIVA\tGR1, GR2\n\tRET\n\tEND\n", comet2.SVC_EXIT_STATUS + comet2.EXIT_DVZ},
+	}
+	for _, c := range cases {
+		if _, status := runC2C2(t, c.src); status != c.want {
+			t.Errorf("%q: exit status = %d, want %d", c.src, status, c.want)
+		}
+	}
+}
+
+func TestStackTop(t *testing.T) {
+	src := `MAIN	START
+	CALL	MAIN
+	END
+`
+	instructions := func(output string) int {
+		t.Helper()
+		if !strings.Contains(output, "Stack overflow") {
+			t.Fatalf("Expected stack overflow:\n%s", output)
+		}
+		idx := strings.Index(output, "Instructions: ")
+		if idx < 0 {
+			t.Fatalf("No stats in output:\n%s", output)
+		}
+		n, _ := strconv.Atoi(strings.Fields(output[idx+len("Instructions: "):])[0])
+		return n
+	}
+
+	small := instructions(runMonitor(t, src, "run\ninfo stats\nq\n", "-stack", "#0010"))
+	// 13 return addresses fit in #0003-#000f; the 14th CALL overflows
+	if small != 14 {
+		t.Errorf("CALLs until overflow with -stack #0010 = %d, want 14", small)
+	}
+	if def := instructions(runMonitor(t, src, "run\ninfo stats\nq\n")); def <= small {
+		t.Errorf("Default stack overflowed after %d CALLs, not later than %d", def, small)
+	}
+
+	output := runMonitor(t, src, "q\n", "-stack", "#0001")
+	if !strings.Contains(output, "Invalid stack top") {
+		t.Errorf("Expected error for a stack top inside the program:\n%s", output)
+	}
+}
+
+func TestMonitorNext(t *testing.T) {
+	src := `MAIN	START
+	LD	GR1, DATA
+	CALL	SUB
+	ADDA	GR1, DATA
+	RET
+DATA	DC	1
+	END
+SUB	START
+	LAD	GR1, 100, GR1
+	RET
+	END
+`
+	output := runMonitor(t, src, "next\nnext\nq\n")
+
+	if !strings.Contains(output, "Reached #0004") || !strings.Contains(output, "PR  #0004") {
+		t.Fatalf("next did not stop after the CALL:\n%s", output)
+	}
+	if !strings.Contains(output, "GR1 #0065(   101)") {
+		t.Errorf("Subroutine effect missing after next:\n%s", output)
+	}
+}
+
+func TestMonitorFinish(t *testing.T) {
+	src := `MAIN	START
+	CALL	SUBA
+	RET
+	END
+SUBA	START
+	CALL	SUBB
+	LAD	GR1, 1
+	RET
+	END
+SUBB	START
+	LAD	GR2, 2
+	RET
+	END
+`
+	// Stop inside SUBA before it calls SUBB; SUBB's RET must not end finish
+	output := runMonitor(t, src, "goto #0003\nfinish\nq\n")
+
+	if !strings.Contains(output, "Returned to #0002") {
+		t.Fatalf("finish did not return to the caller:\n%s", output)
+	}
+	if !strings.Contains(output, "GR1 #0001") || !strings.Contains(output, "GR2 #0002") {
+		t.Errorf("Subroutines did not complete before finish stopped:\n%s", output)
+	}
+	if strings.Contains(output, "Program finished") {
+		t.Errorf("finish ran past the caller:\n%s", output)
+	}
+}
+
+func TestMonitorDisasmLabels(t *testing.T) {
+	src := `MAIN	START
+	LD	GR1, DATA
+	CALL	SUB
+	RET
+DATA	DC	5
+	END
+SUB	START
+	RET
+	END
+`
+	output := runMonitor(t, src, "disasm\nq\n")
+
+	for _, want := range []string{"MAIN:\n", "#0000  LD    GR1,   #0005 (DATA)\n", "#0002  CALL  #0006 (SUB)\n", "DATA:\n#0005"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("%q missing from disassembly:\n%s", want, output)
+		}
+	}
+}
+
+func TestListingFile(t *testing.T) {
+	casFile := "test/samples/program1/sample11.cas"
+	lstFile := filepath.Join(t.TempDir(), "out.lst")
+
+	output, err := exec.Command("./c2c2", "-c", "-a", "-L", lstFile, casFile).CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to assemble: %v\nOutput: %s", err, string(output))
+	}
+	if strings.Contains(string(output), "DEFINED SYMBOLS") {
+		t.Errorf("Listing was also printed to stdout:\n%s", string(output))
+	}
+
+	data, err := ioutil.ReadFile(lstFile)
+	if err != nil {
+		t.Fatalf("Failed to read listing: %v", err)
+	}
+	if !strings.Contains(string(data), "CASL LISTING") || !strings.Contains(string(data), "DEFINED SYMBOLS") {
+		t.Errorf("Incomplete listing:\n%s", string(data))
+	}
+	if strings.Contains(string(data), "\x1b[") {
+		t.Errorf("Listing contains color codes:\n%q", string(data))
+	}
+}
+
+func TestListingOnError(t *testing.T) {
+	casFile := writeSource(t, "MAIN\tSTART\n\tLD\tGR1\n\tRET\n\tEND\n")
+
+	// Without -Q, so that the header would be printed
+	out, err := exec.Command("./c2c2", "-c", "-a", casFile).CombinedOutput()
+	output := string(out)
+	if err == nil {
+		t.Fatalf("Expected the assembly to fail\nOutput: %s", output)
+	}
+	if strings.Contains(output, "CASL LISTING") {
+		t.Errorf("Listing header printed for a failed assembly:\n%s", output)
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	src := `MAIN	START
+	LAD	GR1, 1
+	CPA	GR1, =0
+	JZE	SKIP
+	RET
+SKIP	LAD	GR2, 2
+	RET
+	END
+`
+	output, status := runC2C2(t, src, "-cov")
+	if status != 0 {
+		t.Fatalf("c2c2 exited with status %d\nOutput: %s", status, output)
+	}
+
+	for _, want := range []string{"   4 +\t\tJZE\tSKIP\n", "   6 -\tSKIP\tLAD\tGR2, 2\n", "   7 -\t\tRET\t\n", "Executed 4 of 6 lines\n"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("%q missing from coverage report:\n%s", want, output)
+		}
+	}
+}
+
+func TestProfile(t *testing.T) {
+	src := `MAIN	START
+	LAD	GR1, 10
+LOOP	SUBA	GR1, =1
+	JNZ	LOOP
+	RET
+	END
+`
+	output, status := runC2C2(t, src, "-profile")
+	if status != 0 {
+		t.Fatalf("c2c2 exited with status %d\nOutput: %s", status, output)
+	}
+
+	_, report, found := strings.Cut(output, "PROFILE\n")
+	if !found {
+		t.Fatalf("No profile in output:\n%s", output)
+	}
+	lines := strings.Split(strings.TrimRight(report, "\n"), "\n")
+	// The loop body runs 10 times; ties are listed by address
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "      10 #0002\tSUBA") || !strings.HasSuffix(lines[0], "(line 3)") {
+		t.Errorf("Unexpected profile:\n%s", report)
+	}
+}
+
+func TestEOFOnIN(t *testing.T) {
+	src := `MAIN	START
+	IN	BUF, LEN
+	IN	BUF, LEN
+	OUT	BUF, LEN
+	RET
+BUF	DS	8
+LEN	DS	1
+	END
+`
+	casFile := writeSource(t, src)
+
+	// Only one of the two lines is given
+	output, err := exec.Command("./c2c2", "-n", "-Q", casFile, "abc").CombinedOutput()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 1 {
+		t.Errorf("Expected exit status 1, got %v", err)
+	}
+	if !strings.Contains(string(output), "EOF on IN at #0014") {
+		t.Errorf("Missing EOF message:\n%s", string(output))
+	}
+
+	// With -eofempty the second IN reads an empty line and OUT prints it
+	output, err = exec.Command("./c2c2", "-n", "-Q", "-eofempty", casFile, "abc").CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to run c2c2: %v\nOutput: %s", err, string(output))
+	}
+	if string(output) != "abc\n\nProgram finished (RET)\n" {
+		t.Errorf("Unexpected output:\n%q", string(output))
+	}
+}
+
+func TestMonitorExamine(t *testing.T) {
+	src := `MAIN	START
+	LD	GR1, DATA
+	RET
+DATA	DC	-2
+	END
+`
+	output := runMonitor(t, src, "x #0000\nx #0003\nq\n")
+
+	for _, want := range []string{"#0000 <MAIN>: #1010 4112\tLD\tGR1,   #0003\n", "#0003 <DATA>: #fffe -2\n"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("%q missing from output:\n%s", want, output)
+		}
+	}
+}
+
+func TestLink(t *testing.T) {
+	dir := t.TempDir()
+	mainFile := filepath.Join(dir, "main.cas")
+	subFile := filepath.Join(dir, "sub.cas")
+	if err := ioutil.WriteFile(mainFile, []byte("MAIN\tSTART\n\tIN\tBUF, LEN\n\tCALL\tPRINT\n\tRET\nBUF\tDS\t8\nLEN\tDS\t1\n\tEND\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(subFile, []byte("PRINT\tSTART\n\tOUT\tMSG, LEN\n\tRET\nMSG\tDC\t'sub'\nLEN\tDC\t3\n\tEND\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := exec.Command("./c2c2", "-n", "-Q", "-link", mainFile, subFile, "--", "abc").CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to run c2c2: %v\nOutput: %s", err, string(output))
+	}
+	// The buffered input is echoed before the subroutine's output
+	if string(output) != "abc\nsub\nProgram finished (RET)\n" {
+		t.Errorf("Unexpected output:\n%q", string(output))
+	}
+
+	// Errors in a linked file name that file
+	if err := ioutil.WriteFile(subFile, []byte("PRINT\tSTART\n\tJUMP\tNOWHERE\n\tEND\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output, _ = exec.Command("./c2c2", "-n", "-Q", "-link", mainFile, subFile).CombinedOutput()
+	if !strings.Contains(string(output), subFile+": Line 2: Undefined label \"NOWHERE\"") {
+		t.Errorf("Unexpected error output:\n%s", string(output))
+	}
+}
+
+func TestMonitorHistory(t *testing.T) {
+	output := runMonitor(t, straightLineProgram, "info stats\ns\n!2\nhistory\np\n!9\nq\n")
+
+	// !2 runs the second command, step, again
+	if !strings.Contains(output, "PR  #0004") {
+		t.Errorf("Expected PC #0004 after recalling step:\n%s", output)
+	}
+	if !strings.Contains(output, "    1  info stats\n    2  s\n    3  s\n    4  history\n") {
+		t.Errorf("Unexpected history:\n%s", output)
+	}
+	if !strings.Contains(output, "No command 9 in history") {
+		t.Errorf("Expected error for unknown command number:\n%s", output)
+	}
+}
+
+func TestMonitorDisasmFormat(t *testing.T) {
+	src := `MAIN	START
+	LD	GR1, DATA, GR2
+	RET
+DATA	DC	5
+	END
+`
+	output := runMonitor(t, src, "di #0000 2\nq\n")
+	if strings.Contains(output, "\x1b[") {
+		t.Errorf("Color codes with -n:\n%q", output)
+	}
+	want := "MAIN:\n#0000  LD    GR1,   #0003 (DATA), GR2\n#0002  RET\ncomet2> "
+	if !strings.Contains(output, want) {
+		t.Errorf("Unexpected disassembly:\n%s", output)
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	src := `MAIN	START
+	LD	GR1, BUF
+	ST	GR1, TMP
+	LD	GR2, TMP
+	LD	GR3, INIT
+	RET
+BUF	DS	1
+TMP	DS	1
+INIT	DS	1, 5
+	END
+`
+	output, status := runC2C2(t, src, "-sanitize")
+	if status != 0 {
+		t.Fatalf("c2c2 exited with status %d\nOutput: %s", status, output)
+	}
+	// Only BUF is read before a store; TMP is stored first and INIT is filled
+	if got := strings.Count(output, "Read of uninitialized memory"); got != 1 {
+		t.Errorf("Expected 1 warning, got %d:\n%s", got, output)
+	}
+	if !strings.Contains(output, "Read of uninitialized memory at #0009") {
+		t.Errorf("Warning for BUF missing:\n%s", output)
+	}
+
+	output, _ = runC2C2(t, src)
+	if strings.Contains(output, "uninitialized") {
+		t.Errorf("Warning printed without -sanitize:\n%s", output)
+	}
+}
+
+func TestTrapOverflow(t *testing.T) {
+	src := `MAIN	START
+	LAD	GR1, 32767
+	ADDA	GR1, =1
+	LAD	GR2, 1
+	RET
+	END
+`
+	output, _ := runC2C2(t, src, "-trapov")
+	if !strings.Contains(output, "Arithmetic overflow at #0002") {
+		t.Errorf("Overflow not trapped:\n%s", output)
+	}
+
+	output, _ = runC2C2(t, src)
+	if strings.Contains(output, "Arithmetic overflow") {
+		t.Errorf("Overflow trapped without -trapov:\n%s", output)
+	}
+
+	// The trap ends the program like SVC 3 (ROV)
+	if _, status := runC2C2(t, src, "-trapov"); status != comet2.SVC_EXIT_STATUS+comet2.EXIT_ROV {
+		t.Errorf("Exit status = %d, want %d", status, comet2.SVC_EXIT_STATUS+comet2.EXIT_ROV)
+	}
+
+	// A resumed run traps the next overflow even though OF is still set,
+	// but not an instruction that leaves FR alone
+	src = `MAIN	START
+	LAD	GR1, 32767
+	ADDA	GR1, =1
+	SUBA	GR1, =1
+	LAD	GR2, 1
+	RET
+	END
+`
+	out := runMonitor(t, src, "run\nrun\nrun\nq\n", "-trapov")
+	for _, want := range []string{"Arithmetic overflow at #0002", "Arithmetic overflow at #0004", "Program finished (RET)"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("%q missing:\n%s", want, out)
+		}
+	}
+	if n := strings.Count(out, "Arithmetic overflow"); n != 2 {
+		t.Errorf("Overflow trapped %d times, want 2:\n%s", n, out)
+	}
+}
+
+func TestMonitorContinue(t *testing.T) {
+	output := runMonitor(t, straightLineProgram, "b #0004\nc\ncontinue\nq\n")
+
+	// Nothing is printed between the command and the stop
+	if !strings.Contains(output, "comet2> Breakpoint at #0004\n") {
+		t.Fatalf("continue did not stop at breakpoint:\n%s", output)
+	}
+	if strings.Count(output, "PR  #") != 1 {
+		t.Errorf("Registers printed while running:\n%s", output)
+	}
+	if !strings.Contains(output, "comet2> Program finished (RET)") {
+		t.Errorf("Second continue did not finish the program:\n%s", output)
+	}
+}
+
+func TestJumpCheck(t *testing.T) {
+	src := `MAIN	START
+	JUMP	NEXT+1
+NEXT	LAD	GR1, 0
+	RET
+	END
+`
+	output, _ := runC2C2(t, src, "-jumpcheck")
+	if !strings.Contains(output, "Jump into the middle of the instruction at #0002: PC = #0003") {
+		t.Errorf("Warning missing:\n%s", output)
+	}
+
+	output, _ = runC2C2(t, src)
+	if strings.Contains(output, "Jump into the middle") {
+		t.Errorf("Warning printed without -jumpcheck:\n%s", output)
+	}
+}
+
+func TestNoBanner(t *testing.T) {
+	casFile := writeSource(t, straightLineProgram)
+	cmd := exec.Command("./c2c2", "-n", "--no-banner", casFile)
+	cmd.Stdin = strings.NewReader("q\n")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to run c2c2: %v\nOutput: %s", err, string(output))
+	}
+
+	if strings.Contains(string(output), "This is CASL II") || strings.Contains(string(output), "This is COMET II") {
+		t.Errorf("Banner printed:\n%s", string(output))
+	}
+	for _, want := range []string{"Successfully assembled.", "PR  #0000"} {
+		if !strings.Contains(string(output), want) {
+			t.Errorf("%q missing:\n%s", want, string(output))
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	src := `MAIN	START
+	LEA	GR1, 0
+	LD	GR1, DATA
+	JUMP	NOWHERE
+	LD	GR9, DATA
+DATA	DC	1
+UNUSED	DC	2
+	RET
+	END
+`
+	casFile := writeSource(t, src)
+	output, err := exec.Command("./c2c2", "-diagnostics", casFile).Output()
+	if err == nil {
+		t.Errorf("Expected a failing exit status")
+	}
+
+	var diags []Diagnostic
+	if err := json.Unmarshal(output, &diags); err != nil {
+		t.Fatalf("Unmarshal failed: %v\nOutput: %s", err, string(output))
+	}
+	want := []Diagnostic{
+		{casFile, 2, 2, "error", "Illegal instruction \"LEA\""},
+		{casFile, 5, 5, "error", "Invalid register \"GR9\""},
+		{casFile, 4, 7, "error", "Undefined label \"NOWHERE\""},
+		{casFile, 7, 1, "warning", "Label 'UNUSED' is never referenced"},
+	}
+	if !reflect.DeepEqual(diags, want) {
+		t.Errorf("diagnostics = %+v, want %+v", diags, want)
+	}
+}
+
+func TestMonitorLabelAddress(t *testing.T) {
+	src := `MAIN	START
+	LAD	GR1, 1
+	CALL	SUB
+LAST	LAD	GR3, 3
+	RET
+	END
+SUB	START
+LAST	LAD	GR2, 2
+	RET
+	END
+`
+	output := runMonitor(t, src, "b MAIN:LAST\nb SUB\nb LAST\nrun\nrun\nq\n")
+
+	for _, want := range []string{
+		"Breakpoint set at #0004\n",
+		"Breakpoint set at #0007\n",
+		"Label \"LAST\" is ambiguous: MAIN:LAST, SUB:LAST",
+		"Breakpoint at #0007\n",
+		"Breakpoint at #0004\n",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("%q missing from output:\n%s", want, output)
+		}
+	}
+	if !strings.Contains(output, "PR  #0007 [ LAD\t\tGR2") {
+		t.Errorf("Execution did not stop in SUB:\n%s", output)
+	}
+}
+
+func TestStackWarning(t *testing.T) {
+	// Recurses until the stack overflows into the program
+	src := `MAIN	START
+LOOP	CALL	LOOP
+	END
+`
+	output, _ := runC2C2(t, src, "-stack", "#0100", "-stackwarn", "16")
+	warning := strings.Index(output, "Stack is within 16 words of the program at #0000: SP = #0012")
+	overflow := strings.Index(output, "Stack overflow")
+	if warning < 0 || overflow < 0 || warning > overflow {
+		t.Errorf("Expected the warning before the overflow:\n%s", output)
+	}
+	if strings.Count(output, "Stack is within") != 1 {
+		t.Errorf("Expected a single warning:\n%s", output)
+	}
+
+	output, _ = runC2C2(t, src, "-stack", "#0100")
+	if strings.Contains(output, "Stack is within") {
+		t.Errorf("Warning printed without -stackwarn:\n%s", output)
+	}
+}
+
+func TestStdinSource(t *testing.T) {
+	for _, args := range [][]string{{"-n", "-c", "-"}, {"-n", "-c", "--stdin"}} {
+		cmd := exec.Command("./c2c2", args...)
+		cmd.Stdin = strings.NewReader(straightLineProgram)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v: failed to run c2c2: %v\nOutput: %s", args, err, string(output))
+		}
+		if !strings.Contains(string(output), "Successfully assembled.") {
+			t.Errorf("%v: not assembled:\n%s", args, string(output))
+		}
+	}
+
+	// IN takes its inputs from the arguments, never from stdin
+	src := `MAIN	START
+	IN	BUF, LEN
+	OUT	BUF, LEN
+	RET
+BUF	DS	16
+LEN	DS	1
+	END
+`
+	cmd := exec.Command("./c2c2", "-n", "-Q", "--stdin", "hello")
+	cmd.Stdin = strings.NewReader(src)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to run c2c2: %v\nOutput: %s", err, string(output))
+	}
+	if !strings.Contains(string(output), "hello\nhello\n") {
+		t.Errorf("Input not echoed:\n%s", string(output))
+	}
+
+	cmd = exec.Command("./c2c2", "-diagnostics", "-")
+	cmd.Stdin = strings.NewReader("MAIN\tSTART\n\tJUMP\tNOWHERE\n\tEND\n")
+	output, _ = cmd.Output()
+	var diags []Diagnostic
+	if err := json.Unmarshal(output, &diags); err != nil {
+		t.Fatalf("Invalid JSON: %v\n%s", err, string(output))
+	}
+	if len(diags) != 1 || diags[0].File != STDIN_NAME {
+		t.Errorf("Diagnostics = %+v, want one error in %s", diags, STDIN_NAME)
+	}
+}
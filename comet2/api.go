@@ -0,0 +1,295 @@
+package comet2
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Embedding API
+//
+// Assemble and Machine wrap the assembler and the emulator for front ends
+// such as a web playground. The c2c2 monitor runs its program on a Machine
+// as well, adding breakpoints, history and the command line settings
+// around it; other Machines share none of that.
+
+// Assemble assembles CASL2 source text and returns the memory image, the
+// start address and the labels it defines
+func Assemble(source string) ([]uint16, uint16, []Symbol, error) {
+	asmState := NewAssemblerState()
+	image, start, err := AssembleSource(source, "", asmState)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return image, start, asmState.Symbols(), nil
+}
+
+// Machine is a COMET2 with its own memory, registers and settings
+type Machine struct {
+	memory []uint16
+	state  []int
+	image  []uint16
+	start  uint16
+
+	// In supplies a line for each IN; nil reads an empty line
+	In InputFunc
+	// Out receives the text written by each OUT; nil discards it
+	Out OutputFunc
+	// Warn receives runtime warnings; nil discards them
+	Warn func(string)
+	// OnWrite is called with the old value before each word is stored
+	OnWrite func(addr int, old uint16)
+
+	// StackTop is the initial SP; Reset applies a change
+	StackTop int
+	// AddressMax is the end of the program, which PUSH and CALL must not
+	// reach
+	AddressMax int
+	// InputLimit is the most bytes stored by one IN
+	InputLimit int
+	// Strict refuses words that are not valid instructions
+	Strict bool
+	// DivContinue sets ZF and OF on division by zero instead of stopping
+	DivContinue bool
+	// StackWarn warns once when SP comes within this many words of the
+	// program; 0 disables it
+	StackWarn int
+	// Uninitialized holds the words that warn when read before written
+	Uninitialized map[int]bool
+
+	// Finished is set once the program returns, ends with SVC or faults
+	Finished bool
+	// ExitStatus is 0 after RET, SVC_EXIT_STATUS+N after SVC N and the
+	// fault's status after a fault
+	ExitStatus int
+	// Instructions and Cycles count the executed instructions and their
+	// estimated cycles
+	Instructions int
+	Cycles       int
+
+	stackWarned bool
+}
+
+// NewMachine loads image at address 0 and sets PC to start
+func NewMachine(image []uint16, start uint16) *Machine {
+	m := &Machine{
+		memory:     make([]uint16, MEMORY_SIZE),
+		state:      make([]int, SP+1),
+		image:      image,
+		start:      start,
+		StackTop:   STACK_TOP,
+		AddressMax: len(image),
+		InputLimit: 256,
+	}
+	m.Reset()
+	return m
+}
+
+// Reset reloads the image and restores the registers and counters to their
+// state at load time
+func (m *Machine) Reset() {
+	clear(m.memory)
+	copy(m.memory, m.image)
+	copy(m.state, []int{int(m.start), FR_PLUS, 0, 0, 0, 0, 0, 0, 0, 0, m.StackTop})
+
+	m.Finished = false
+	m.ExitStatus = 0
+	m.Instructions = 0
+	m.Cycles = 0
+	m.stackWarned = false
+}
+
+// Memory returns the 64K words of memory; storing into it directly skips
+// Uninitialized and OnWrite
+func (m *Machine) Memory() []uint16 {
+	return m.memory
+}
+
+// Registers returns the registers, indexed by PC, FR, GR0-GR7 and SP
+func (m *Machine) Registers() []int {
+	return m.state
+}
+
+// Step executes one instruction, including the IN or OUT it may perform
+func (m *Machine) Step() error {
+	if m.Finished {
+		return fmt.Errorf("Program already finished")
+	}
+
+	stopFlag, err := m.Execute()
+	if err != nil {
+		var exit *SVCExit
+		var fault *Fault
+		switch {
+		case errors.As(err, &exit):
+			m.Finished = true
+			m.ExitStatus = SVC_EXIT_STATUS + exit.Code
+			return nil
+		case strings.HasPrefix(err.Error(), "Program finished"):
+			m.Finished = true
+			return nil
+		case errors.As(err, &fault):
+			m.Finished = true
+			m.ExitStatus = fault.Status
+		}
+		return err
+	}
+
+	// Execute stops at SVC IN and leaves reading the line to the caller
+	if stopFlag {
+		line := ""
+		if m.In != nil {
+			line = m.In()
+		}
+		m.Input(line)
+	}
+	return nil
+}
+
+// Run executes until the program finishes or maxSteps instructions have
+// run; 0 means no limit
+func (m *Machine) Run(maxSteps int) error {
+	for steps := 0; !m.Finished; steps++ {
+		if maxSteps > 0 && steps >= maxSteps {
+			return fmt.Errorf("Execution limit reached (%d steps) at #%s", maxSteps, hex(m.state[PC], 4))
+		}
+		if err := m.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PC returns the program counter
+func (m *Machine) PC() uint16 {
+	return uint16(m.state[PC])
+}
+
+// SP returns the stack pointer
+func (m *Machine) SP() uint16 {
+	return uint16(m.state[SP])
+}
+
+// FR returns the flag register
+func (m *Machine) FR() int {
+	return m.state[FR]
+}
+
+// GR returns general register n (0-7)
+func (m *Machine) GR(n int) (uint16, error) {
+	if n < 0 || n > 7 {
+		return 0, fmt.Errorf("Invalid register GR%d", n)
+	}
+	return uint16(m.state[GR0+n]), nil
+}
+
+// SetGR sets general register n (0-7)
+func (m *Machine) SetGR(n int, val uint16) error {
+	if n < 0 || n > 7 {
+		return fmt.Errorf("Invalid register GR%d", n)
+	}
+	m.state[GR0+n] = int(val)
+	return nil
+}
+
+// Read returns the word at addr
+func (m *Machine) Read(addr uint16) uint16 {
+	return m.memory[addr]
+}
+
+// Write stores val at addr
+func (m *Machine) Write(addr uint16, val uint16) {
+	m.put(int(addr), int(val))
+}
+
+// Symbol is a label of the symbol table, as listed by Assemble and the
+// JSON output
+type Symbol struct {
+	Name    string `json:"name"`
+	Scope   string `json:"scope"`
+	Address int    `json:"address"`
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+}
+
+// Symbols returns the labels in the symbol table sorted by address,
+// with scope:label names split apart and literals left out
+func (asmState *AssemblerState) Symbols() []Symbol {
+	symbols := []Symbol{}
+	for name, entry := range asmState.symtbl {
+		idx := strings.Index(name, ":")
+		if strings.HasPrefix(name, "=") || idx < 0 {
+			continue
+		}
+		symbols = append(symbols, Symbol{
+			Name:    name[idx+1:],
+			Scope:   name[:idx],
+			Address: expandLabel(asmState.symtbl, name),
+			File:    entry.File,
+			Line:    entry.Line,
+		})
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		if symbols[i].Address != symbols[j].Address {
+			return symbols[i].Address < symbols[j].Address
+		}
+		if symbols[i].Line != symbols[j].Line {
+			return symbols[i].Line < symbols[j].Line
+		}
+		return symbols[i].Name < symbols[j].Name
+	})
+	return symbols
+}
+
+// Errors returns the errors recorded with KeepGoing
+func (asmState *AssemblerState) Errors() []error {
+	return asmState.errs
+}
+
+// MainFile returns the name of the source file given to the assembler
+func (asmState *AssemblerState) MainFile() string {
+	return asmState.mainFile
+}
+
+// AddressMax returns the end of the program, which the stack must not reach
+func (asmState *AssemblerState) AddressMax() int {
+	return asmState.addressMax
+}
+
+// ListingLines returns the listing collected with Listing, without its
+// header
+func (asmState *AssemblerState) ListingLines() []string {
+	return asmState.outdump
+}
+
+// Word is the origin of an assembled word
+type Word struct {
+	File string
+	Line int
+	// Source is the source line as shown in listings
+	Source string
+	// Code marks the first word of an instruction
+	Code bool
+	// Reserved marks a word reserved by DS without a fill value
+	Reserved bool
+	// Operand marks the address word of a two-word instruction
+	Operand bool
+}
+
+// Word returns the origin of the word at addr, or false if the program
+// puts nothing there
+func (asmState *AssemblerState) Word(addr int) (Word, bool) {
+	entry, ok := asmState.memory[addr]
+	if !ok {
+		return Word{}, false
+	}
+	return Word{
+		File:     entry.File,
+		Line:     entry.Line,
+		Source:   listingSource(asmState, sourcePos{File: entry.File, Line: entry.Line}),
+		Code:     entry.Code,
+		Reserved: entry.Reserved,
+		Operand:  entry.Operand,
+	}, true
+}
@@ -0,0 +1,93 @@
+package comet2
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAssembleAndRun(t *testing.T) {
+	src := `MAIN	START	BEGIN
+BUF	DS	16
+LEN	DS	1
+BEGIN	IN	BUF, LEN
+	LD	GR1, LEN
+	OUT	BUF, LEN
+	RET
+	END
+`
+	image, start, symbols, err := Assemble(src)
+	if err != nil {
+		t.Fatalf("Assemble failed: %v", err)
+	}
+	if start != 17 {
+		t.Errorf("start = #%s, want #0011", hex(int(start), 4))
+	}
+	found := false
+	for _, sym := range symbols {
+		if sym.Scope == "MAIN" && sym.Name == "LEN" && sym.Address == 16 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("LEN missing from symbols: %+v", symbols)
+	}
+
+	m := NewMachine(image, start)
+	var output []string
+	m.In = func() string { return "hello" }
+	m.Out = func(msg string) { output = append(output, msg) }
+
+	if err := m.Run(0); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if !m.Finished || m.ExitStatus != 0 {
+		t.Errorf("Finished, ExitStatus = %v, %d, want true, 0", m.Finished, m.ExitStatus)
+	}
+	if len(output) != 1 || output[0] != "hello" {
+		t.Errorf("output = %q, want [\"hello\"]", output)
+	}
+	if gr1, err := m.GR(1); err != nil || gr1 != 5 || m.Read(16) != 5 {
+		t.Errorf("GR1, LEN = %d, %d (%v), want 5, 5", gr1, m.Read(16), err)
+	}
+
+	// Errors are reported with their line
+	if _, _, _, err := Assemble("MAIN\tSTART\n\tLEA\tGR1, 0\n\tEND\n"); err == nil || !strings.Contains(err.Error(), "Line 2") {
+		t.Errorf("Expected error on line 2, got %v", err)
+	}
+}
+
+func TestMachineRegisterRange(t *testing.T) {
+	m := NewMachine(nil, 0)
+	for _, n := range []int{-1, 8, 9} {
+		if _, err := m.GR(n); err == nil {
+			t.Errorf("GR(%d) succeeded", n)
+		}
+		if err := m.SetGR(n, 1); err == nil {
+			t.Errorf("SetGR(%d) succeeded", n)
+		}
+	}
+	if m.SP() != STACK_TOP || m.FR() != FR_PLUS {
+		t.Errorf("SP, FR = #%s, %d, changed by SetGR", hex(int(m.SP()), 4), m.FR())
+	}
+	if err := m.SetGR(7, 3); err != nil {
+		t.Errorf("SetGR(7) failed: %v", err)
+	}
+	if gr7, _ := m.GR(7); gr7 != 3 {
+		t.Errorf("GR7 = %d, want 3", gr7)
+	}
+}
+
+func TestMachineStepLimit(t *testing.T) {
+	// LOOP: JUMP LOOP
+	m := NewMachine([]uint16{0x6400, 0x0000}, 0)
+	err := m.Run(100)
+	if err == nil || !strings.Contains(err.Error(), "Execution limit reached (100 steps)") {
+		t.Errorf("Expected limit error, got %v", err)
+	}
+
+	// SVC 2 ends the program with status 12
+	m = NewMachine([]uint16{0xf000, 0x0002}, 0)
+	if err := m.Run(0); err != nil || m.ExitStatus != SVC_EXIT_STATUS+2 {
+		t.Errorf("Run = %v with status %d, want nil with status 12", err, m.ExitStatus)
+	}
+}
@@ -0,0 +1,1562 @@
+package comet2
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// AssembleFile assembles the source file at inputFilepath and returns the
+// memory image and the start address
+func AssembleFile(inputFilepath string, asmState *AssemblerState) ([]uint16, uint16, error) {
+	// Read source file
+	content, err := ioutil.ReadFile(inputFilepath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("[CASL2 ERROR] Cannot read file: %v", err)
+	}
+
+	return AssembleSource(string(content), inputFilepath, asmState)
+}
+
+// AssembleSource assembles source text read from elsewhere, such as
+// standard input; name is used in error messages and as the base for
+// INCLUDE paths
+func AssembleSource(source, name string, asmState *AssemblerState) ([]uint16, uint16, error) {
+	image, startLabel, err := assembleText(source, name, asmState)
+	if err != nil {
+		return nil, 0, err
+	}
+	return image, uint16(expandLabel(asmState.symtbl, startLabel)), nil
+}
+
+// assembleText assembles source text; name is used in error messages and
+// as the base for INCLUDE paths
+func assembleText(casl2code, name string, asmState *AssemblerState) ([]uint16, string, error) {
+	asmState.file = name
+	asmState.mainFile = name
+
+	// Pass 1: Build symbol table
+	startLabel, err := pass1(casl2code, asmState)
+
+	// Pass 2: Generate binary
+	var comet2bin []uint16
+	if err == nil {
+		comet2bin, err = pass2(asmState)
+	}
+
+	// With KeepGoing, the error that stopped the assembly joins the ones
+	// recorded so far, and all of them are reported, one per line
+	if asmState.KeepGoing {
+		if err != nil {
+			asmState.errs = append(asmState.errs, err)
+		}
+		if len(asmState.errs) > 0 {
+			return nil, "", errors.Join(asmState.errs...)
+		}
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	return comet2bin, startLabel, nil
+}
+
+func pass1(source string, asmState *AssemblerState) (string, error) {
+	var inBlock bool
+	var address int
+	var literalStack []string
+	literalNames := make(map[string]string)
+	var comet2startLabel string
+	var startPos sourcePos
+
+	asmState.line = 0
+	lines, err := expandIncludes(asmState, source, asmState.file, map[string]bool{})
+	if err != nil {
+		return "", err
+	}
+	// Linked files follow the main file as if they were included at its end
+	for _, file := range asmState.LinkFiles {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("[CASL2 ERROR] Cannot read file: %v", err)
+		}
+		linked, err := expandIncludes(asmState, string(content), file, map[string]bool{})
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, linked...)
+	}
+
+	for _, src := range lines {
+		asmState.file = src.File
+		asmState.line = src.Line
+		asmState.column = 0
+		line := src.Text
+
+		// Remove comments
+		if idx := strings.Index(line, ";"); idx >= 0 {
+			// Check if semicolon is inside quotes
+			hasQuote := false
+			for j := 0; j < idx; j++ {
+				if line[j] == '\'' {
+					hasQuote = !hasQuote
+				}
+			}
+			if !hasQuote {
+				line = line[:idx]
+			}
+		}
+
+		line = normalizeSpaces(line)
+
+		// Remove trailing spaces
+		line = strings.TrimRight(line, " \t")
+
+		// Skip empty lines; comment-only lines are kept for the listing
+		if strings.TrimSpace(line) == "" {
+			if comment := strings.TrimSpace(src.Text); comment != "" {
+				asmState.buf[src.sourcePos] = "\t" + comment
+				asmState.order = append(asmState.order, src.sourcePos)
+			}
+			continue
+		}
+
+		// Extract label, instruction, and operands
+		var label, inst, opr string
+		re1 := regexp.MustCompile(`^(\S+)?\s+([A-Za-z]+)(\s+(.*))?$`)
+		re2 := regexp.MustCompile(`^(\S+)\s*$`)
+
+		var instCol, oprCol int
+		if matches := re1.FindStringSubmatchIndex(line); matches != nil {
+			if matches[2] >= 0 {
+				label = line[matches[2]:matches[3]]
+			}
+			// Mnemonics are case-insensitive, labels are not
+			inst = strings.ToUpper(line[matches[4]:matches[5]])
+			instCol = sourceColumn(line, matches[4])
+			if matches[8] >= 0 {
+				opr = line[matches[8]:matches[9]]
+				oprCol = sourceColumn(line, matches[8])
+				asmState.operands[src.sourcePos] = operandField{oprCol, opr}
+			}
+		} else if matches := re2.FindStringSubmatch(line); matches != nil {
+			label = matches[1]
+		} else {
+			err := syntaxError(asmState, line)
+			if err == nil {
+				err = errorCasl2(asmState, fmt.Sprintf("Syntax error: %s", line))
+			}
+			if err := lineError(asmState, err); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		// Keep every line in buf
+		uniqLabel := ""
+		if label != "" {
+			uniqLabel = asmState.varScope + ":" + label
+		}
+		asmState.buf[src.sourcePos] = uniqLabel + "\t" + inst + "\t" + opr
+		asmState.order = append(asmState.order, src.sourcePos)
+
+		// Register label to symbol table
+		if label != "" {
+			asmState.column = 1
+		}
+		labelBound := false
+		if label != "" && inBlock {
+			// A duplicate label is reported, but its line is still assembled
+			if err := addLabel(asmState, label, address); err != nil {
+				if err := lineError(asmState, err); err != nil {
+					return "", err
+				}
+			} else {
+				labelBound = true
+			}
+
+			// Check if label is referred from START instruction
+			if label == asmState.actualLabel {
+				err := updateLabel(asmState, asmState.virtualLabel, address)
+				if err != nil {
+					return "", err
+				}
+				asmState.actualLabel = ""
+			}
+		}
+
+		// Generate object code according to instruction type
+		if inst != "" {
+			asmState.column = instCol
+			instDef, ok := casl2tbl[inst]
+			if !ok {
+				if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("Illegal instruction \"%s\"", inst))); err != nil {
+					return "", err
+				}
+				continue
+			}
+
+			instType := instDef.Type
+			if oprCol > 0 {
+				asmState.column = oprCol
+			}
+
+			// Lenient reads text after the operands as a comment
+			if asmState.Lenient {
+				switch instType {
+				case op4, opRPUSH, opRPOP, opEnd:
+					opr = ""
+				default:
+					opr = stripTrailingComment(opr)
+				}
+			}
+
+			// Parse operands
+			var oprArray []string
+			if strings.TrimSpace(opr) != "" {
+				oprArray = parseOperands(opr)
+			}
+			// Empty operands come from stray commas
+			malformed := strings.HasSuffix(strings.TrimSpace(opr), ",")
+			for _, op := range oprArray {
+				if op == "" {
+					malformed = true
+				}
+			}
+			// A bad line is skipped but keeps its size, so that the labels
+			// after it do not move
+			size := instructionSize(instType, oprArray)
+			if malformed {
+				err := syntaxError(asmState, line)
+				if err == nil {
+					err = errorCasl2(asmState, fmt.Sprintf("Invalid operand \"%s\"", opr))
+				}
+				if err := lineError(asmState, err); err != nil {
+					return "", err
+				}
+				address += size
+				continue
+			}
+
+			// Binary constants are handled as hex from here on
+			badConstant := false
+			for i, op := range oprArray {
+				// The DS count is a number of words, parsed in the DS case
+				if instType == opDS && i == 0 {
+					continue
+				}
+				hexOp, err := binaryToHex(asmState, op)
+				if err != nil {
+					if err := lineError(asmState, err); err != nil {
+						return "", err
+					}
+					badConstant = true
+					break
+				}
+				oprArray[i] = hexOp
+			}
+			if badConstant {
+				address += size
+				continue
+			}
+
+			// START must be the first instruction
+			if !inBlock && instType != opStart {
+				return "", errorCasl2(asmState, "NO \"START\" instruction found")
+			}
+
+			// GR0 cannot be used as index register
+			if len(oprArray) > 2 {
+				if matched, _ := regexp.MatchString(`^(?i)(GR)?0$`, oprArray[2]); matched {
+					if err := lineError(asmState, errorCasl2(asmState, "Can't use GR0 as an index register")); err != nil {
+						return "", err
+					}
+					address += size
+					continue
+				}
+			}
+
+			// Process each instruction type
+			switch instType {
+			case op1:
+				if len(oprArray) < 2 || len(oprArray) > 3 {
+					if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("Invalid operand \"%s\"", opr))); err != nil {
+						return "", err
+					}
+					address += size
+					continue
+				}
+				if len(oprArray) == 2 {
+					oprArray = append(oprArray, "0")
+				}
+
+				// Only OP5 instructions have a GR,GR form
+				if isRegister(oprArray[1]) {
+					switch inst {
+					case "SLA", "SRA", "SLL", "SRL":
+						if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("Shift count of %s must be an address, not register \"%s\"", inst, oprArray[1]))); err != nil {
+							return "", err
+						}
+						address += size
+						continue
+					}
+					if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("%s takes an address, not register \"%s\"", inst, oprArray[1]))); err != nil {
+						return "", err
+					}
+					address += size
+					continue
+				}
+
+				// Handle literals
+				if strings.HasPrefix(oprArray[1], "=") {
+					oprArray[1] = handleLiteral(oprArray[1], &literalStack, literalNames, &asmState.literalCounter)
+				} else if isLabel(oprArray[1]) && !isRegister(oprArray[1]) || isLabelOffset(oprArray[1]) {
+					oprArray[1] = asmState.varScope + ":" + oprArray[1]
+				}
+
+				if err := genCode2(asmState.memory, address, int(instDef.Code), oprArray[0], oprArray[1], oprArray[2], asmState); err != nil {
+					if err := lineError(asmState, err); err != nil {
+						return "", err
+					}
+					address += size
+					continue
+				}
+				address += 2
+
+			case op2:
+				if len(oprArray) < 1 || len(oprArray) > 2 {
+					if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("Invalid operand \"%s\"", opr))); err != nil {
+						return "", err
+					}
+					address += size
+					continue
+				}
+				if len(oprArray) == 1 {
+					oprArray = append(oprArray, "0")
+				}
+				if isRegister(oprArray[0]) {
+					if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("%s takes an address, not register \"%s\"", inst, oprArray[0]))); err != nil {
+						return "", err
+					}
+					address += size
+					continue
+				}
+
+				if !isRegister(oprArray[0]) && isLabel(oprArray[0]) || isLabelOffset(oprArray[0]) {
+					if strings.Contains(inst, "CALL") {
+						oprArray[0] = "CALL_" + asmState.varScope + ":" + oprArray[0]
+					} else {
+						oprArray[0] = asmState.varScope + ":" + oprArray[0]
+					}
+				}
+
+				if err := genCode2(asmState.memory, address, int(instDef.Code), "0", oprArray[0], oprArray[1], asmState); err != nil {
+					if err := lineError(asmState, err); err != nil {
+						return "", err
+					}
+					address += size
+					continue
+				}
+				address += 2
+
+			case op3:
+				if len(oprArray) != 1 {
+					if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("Invalid operand \"%s\"", opr))); err != nil {
+						return "", err
+					}
+					address += size
+					continue
+				}
+				if err := genCode3(asmState.memory, address, int(instDef.Code), oprArray[0], "0", asmState); err != nil {
+					if err := lineError(asmState, err); err != nil {
+						return "", err
+					}
+					address += size
+					continue
+				}
+				address++
+
+			case op4:
+				if len(oprArray) != 0 {
+					if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("Invalid operand \"%s\"", opr))); err != nil {
+						return "", err
+					}
+					address += size
+					continue
+				}
+				genCode1(asmState.memory, address, int(instDef.Code)<<8, asmState)
+				asmState.memory[address].Code = true
+				address++
+
+			case op5:
+				if len(oprArray) < 2 || len(oprArray) > 3 {
+					if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("Invalid operand \"%s\"", opr))); err != nil {
+						return "", err
+					}
+					address += size
+					continue
+				}
+				if len(oprArray) == 2 {
+					oprArray = append(oprArray, "0")
+				}
+
+				// Handle literals
+				if strings.HasPrefix(oprArray[1], "=") {
+					oprArray[1] = handleLiteral(oprArray[1], &literalStack, literalNames, &asmState.literalCounter)
+				} else if isLabel(oprArray[1]) && !isRegister(oprArray[1]) || isLabelOffset(oprArray[1]) {
+					oprArray[1] = asmState.varScope + ":" + oprArray[1]
+				}
+
+				// Check if GR,GR form
+				if isRegister(oprArray[1]) {
+					instCode := int(instDef.Code) + 4
+					if err := genCode3(asmState.memory, address, instCode, oprArray[0], oprArray[1], asmState); err != nil {
+						if err := lineError(asmState, err); err != nil {
+							return "", err
+						}
+						address += size
+						continue
+					}
+					address++
+				} else {
+					if err := genCode2(asmState.memory, address, int(instDef.Code), oprArray[0], oprArray[1], oprArray[2], asmState); err != nil {
+						if err := lineError(asmState, err); err != nil {
+							return "", err
+						}
+						address += size
+						continue
+					}
+					address += 2
+				}
+
+			case opStart:
+				if label == "" {
+					if err := lineError(asmState, errorCasl2(asmState, "No label found at START")); err != nil {
+						return "", err
+					}
+					// Open the block anyway so its lines are still checked
+					inBlock = true
+					continue
+				}
+
+				if asmState.firstStart {
+					asmState.firstStart = false
+					startPos = src.sourcePos
+					if len(oprArray) > 0 {
+						comet2startLabel = label + ":" + oprArray[0]
+					} else {
+						comet2startLabel = label + ":" + label
+					}
+				} else {
+					if len(oprArray) > 0 {
+						asmState.actualLabel = oprArray[0]
+					} else {
+						asmState.actualLabel = ""
+					}
+					asmState.virtualLabel = label
+				}
+
+				// The entry label is referenced by START itself
+				if len(oprArray) > 0 {
+					asmState.refs[label+":"+oprArray[0]] = true
+				}
+
+				asmState.varScope = label
+				if err := addLabel(asmState, label, address); err != nil {
+					if err := lineError(asmState, err); err != nil {
+						return "", err
+					}
+				}
+				inBlock = true
+
+			case opEnd:
+				// The block is closed even when END itself is malformed
+				if label != "" {
+					if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("Can't use label \"%s\" at END", label))); err != nil {
+						return "", err
+					}
+				}
+				if len(oprArray) != 0 {
+					if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("Invalid operand \"%s\"", opr))); err != nil {
+						return "", err
+					}
+				}
+
+				// Expand literals
+				for _, lit := range literalStack {
+					addLiteral(asmState, lit, address)
+					lit = strings.TrimPrefix(lit, "=")
+					lit = lit[:strings.LastIndex(lit, "_")]
+
+					if strings.HasPrefix(lit, "'") && strings.HasSuffix(lit, "'") {
+						chars := decodeString(lit[1 : len(lit)-1])
+						for _, ch := range chars {
+							genCode1(asmState.memory, address, ch, asmState)
+							address++
+						}
+						// A one-character literal is an immediate character
+						// code, not a string
+						if len(chars) != 1 {
+							genCode1(asmState.memory, address, 0, asmState)
+							address++
+						}
+					} else if matched, _ := regexp.MatchString(`^[+-]?\d+|^\#[\da-fA-F]+`, lit); matched {
+						genCode1(asmState.memory, address, lit, asmState)
+						address++
+					} else {
+						if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("Invalid literal =%s", lit))); err != nil {
+							return "", err
+						}
+					}
+				}
+
+				literalStack = nil
+				literalNames = make(map[string]string)
+				asmState.varScope = ""
+				inBlock = false
+
+			case opDS:
+				// A skipped DS reserves nothing, since its size is unknown
+				if len(oprArray) != 1 && len(oprArray) != 2 {
+					if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("Invalid operand \"%s\"", opr))); err != nil {
+						return "", err
+					}
+					continue
+				}
+				count, err := strconv.Atoi(oprArray[0])
+				if matches := binaryRe.FindStringSubmatch(oprArray[0]); matches != nil && matches[1] == "" {
+					num, err := strconv.ParseUint(matches[2], 2, 16)
+					if err != nil {
+						if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("\"%s\" is out of range", oprArray[0]))); err != nil {
+							return "", err
+						}
+						continue
+					}
+					count = int(num)
+				} else if err != nil {
+					// Allow constants defined by EQU
+					val, ok := lookupLabel(asmState, oprArray[0])
+					if !ok {
+						if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("\"%s\" must be decimal", oprArray[0]))); err != nil {
+							return "", err
+						}
+						continue
+					}
+					count = val
+				}
+				// DS 0 reserves nothing and just names the next address
+				if count < 0 {
+					if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("\"%s\" is out of range", oprArray[0]))); err != nil {
+						return "", err
+					}
+					continue
+				}
+				if address+count > MEMORY_SIZE {
+					if err := lineError(asmState, errorCasl2(asmState, "Program exceeds 64K address space")); err != nil {
+						return "", err
+					}
+					continue
+				}
+				// An optional second operand gives the fill value
+				fill := 0
+				if len(oprArray) == 2 {
+					if val, ok := lookupLabel(asmState, oprArray[1]); ok {
+						fill = val & 0xffff
+					} else if val, err := parseConstant(asmState, oprArray[1]); err != nil {
+						if err := lineError(asmState, err); err != nil {
+							return "", err
+						}
+					} else {
+						fill = val
+					}
+				}
+				for j := 0; j < count; j++ {
+					genCode1(asmState.memory, address, fill, asmState)
+					asmState.memory[address].Reserved = len(oprArray) == 1
+					address++
+				}
+
+			case opDC:
+				if len(oprArray) < 1 {
+					if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("Invalid operand \"%s\"", opr))); err != nil {
+						return "", err
+					}
+					continue
+				}
+				for _, op := range oprArray {
+					if strings.HasPrefix(op, "'") && strings.HasSuffix(op, "'") {
+						for _, ch := range decodeString(op[1 : len(op)-1]) {
+							genCode1(asmState.memory, address, ch, asmState)
+							address++
+						}
+						genCode1(asmState.memory, address, 0, asmState)
+						address++
+					} else if strings.HasPrefix(op, "=") {
+						// The word holds the address of the literal
+						op = handleLiteral(op, &literalStack, literalNames, &asmState.literalCounter)
+						genCode1(asmState.memory, address, op, asmState)
+						address++
+					} else if isLabel(op) || isLabelOffset(op) {
+						op = asmState.varScope + ":" + op
+						genCode1(asmState.memory, address, op, asmState)
+						address++
+					} else {
+						// A bad constant still takes its word
+						val, err := parseConstant(asmState, op)
+						if err != nil {
+							if err := lineError(asmState, err); err != nil {
+								return "", err
+							}
+						}
+						genCode1(asmState.memory, address, val, asmState)
+						address++
+					}
+				}
+
+			case opIN, opOUT:
+				if len(oprArray) != 2 {
+					if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("Invalid operand \"%s\"", opr))); err != nil {
+						return "", err
+					}
+					address += size
+					continue
+				}
+
+				checkLabel(asmState, oprArray[0])
+				checkLabel(asmState, oprArray[1])
+
+				oprArray[0] = asmState.varScope + ":" + oprArray[0]
+				oprArray[1] = asmState.varScope + ":" + oprArray[1]
+
+				entry := SYS_IN
+				if instType == opOUT {
+					entry = SYS_OUT
+				}
+
+				genCode2(asmState.memory, address, int(casl2tbl["PUSH"].Code), "0", "0", "1", asmState)
+				genCode2(asmState.memory, address+2, int(casl2tbl["PUSH"].Code), "0", "0", "2", asmState)
+				genCode2(asmState.memory, address+4, int(casl2tbl["LAD"].Code), "1", oprArray[0], "0", asmState)
+				genCode2(asmState.memory, address+6, int(casl2tbl["LAD"].Code), "2", oprArray[1], "0", asmState)
+				genCode2(asmState.memory, address+8, int(casl2tbl["SVC"].Code), "0", strconv.Itoa(entry), "0", asmState)
+				genCode3(asmState.memory, address+10, int(casl2tbl["POP"].Code), "2", "0", asmState)
+				genCode3(asmState.memory, address+11, int(casl2tbl["POP"].Code), "1", "0", asmState)
+				address += 12
+
+			case opRPUSH:
+				if len(oprArray) != 0 {
+					if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("Invalid operand \"%s\"", opr))); err != nil {
+						return "", err
+					}
+					address += size
+					continue
+				}
+				for j := 0; j < 7; j++ {
+					genCode2(asmState.memory, address+j*2, int(casl2tbl["PUSH"].Code), "0", "0", strconv.Itoa(j+1), asmState)
+				}
+				address += 14
+
+			case opRPOP:
+				if len(oprArray) != 0 {
+					if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("Invalid operand \"%s\"", opr))); err != nil {
+						return "", err
+					}
+					address += size
+					continue
+				}
+				for j := 0; j < 7; j++ {
+					genCode3(asmState.memory, address+j, int(casl2tbl["POP"].Code), strconv.Itoa(7-j), "0", asmState)
+				}
+				address += 7
+
+			case opEQU:
+				if label == "" {
+					if err := lineError(asmState, errorCasl2(asmState, "No label found at EQU")); err != nil {
+						return "", err
+					}
+					continue
+				}
+				if len(oprArray) != 1 {
+					if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("Invalid operand \"%s\"", opr))); err != nil {
+						return "", err
+					}
+					continue
+				}
+
+				// EQU binds the label to a constant instead of the current address
+				var val int
+				if num, ok := ExpandNumber(oprArray[0]); ok {
+					val = num
+				} else if num, ok := lookupLabel(asmState, oprArray[0]); ok {
+					val = num
+				} else {
+					if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("Undefined symbol \"%s\"", oprArray[0]))); err != nil {
+						return "", err
+					}
+					continue
+				}
+				// A label that failed to register has already been reported
+				if labelBound {
+					asmState.symtbl[asmState.varScope+":"+label].Val = val
+				}
+
+			case opORG:
+				// A skipped ORG leaves the address where it was
+				if len(oprArray) != 1 {
+					if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("Invalid operand \"%s\"", opr))); err != nil {
+						return "", err
+					}
+					continue
+				}
+
+				var org int
+				if num, ok := lookupLabel(asmState, oprArray[0]); ok {
+					org = num
+				} else if strings.HasPrefix(oprArray[0], "-") {
+					if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("\"%s\" is out of range", oprArray[0]))); err != nil {
+						return "", err
+					}
+					continue
+				} else {
+					num, err := parseConstant(asmState, oprArray[0])
+					if err != nil {
+						if err := lineError(asmState, err); err != nil {
+							return "", err
+						}
+						continue
+					}
+					org = num
+				}
+
+				// Moving backwards would overwrite code already placed
+				if org < address {
+					if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("ORG #%s overlaps code already placed up to #%s", hex(org, 4), hex(address-1, 4)))); err != nil {
+						return "", err
+					}
+					continue
+				}
+				address = org
+				if labelBound {
+					asmState.symtbl[asmState.varScope+":"+label].Val = address
+				}
+
+			default:
+				return "", errorCasl2(asmState, fmt.Sprintf("Instruction type \"%s\" is not implemented", instType))
+			}
+
+			if address > MEMORY_SIZE {
+				return "", errorCasl2(asmState, "Program exceeds 64K address space")
+			}
+		}
+	}
+
+	asmState.column = 0
+	if inBlock {
+		return "", errorCasl2(asmState, "NO \"END\" instruction found")
+	}
+
+	// The entry operand of the first START must name a label in its module
+	if _, ok := asmState.symtbl[comet2startLabel]; !ok && comet2startLabel != "" {
+		asmState.file = startPos.File
+		asmState.line = startPos.Line
+		entry := comet2startLabel[strings.Index(comet2startLabel, ":")+1:]
+		asmState.column = labelColumn(asmState, startPos, entry)
+		return "", errorCasl2(asmState, fmt.Sprintf("Undefined label \"%s\"", entry))
+	}
+
+	asmState.addressMax = address
+	return comet2startLabel, nil
+}
+
+// sourceLine is a line of source text with its origin
+type sourceLine struct {
+	sourcePos
+	Text string
+}
+
+var includeRe = regexp.MustCompile(`(?i)^(\S+)?\s+INCLUDE(\s+(.*))?$`)
+
+// codePart returns line without its ';' comment
+func codePart(line string) string {
+	inQuote := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\'':
+			inQuote = !inQuote
+		case ';':
+			if !inQuote {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+// expandIncludes splits source into lines, splicing in the lines of files
+// referenced by INCLUDE directives. visited holds the files on the current
+// include chain so that cycles are detected.
+func expandIncludes(asmState *AssemblerState, source, file string, visited map[string]bool) ([]sourceLine, error) {
+	key := filepath.Clean(file)
+	if abs, err := filepath.Abs(file); err == nil {
+		key = abs
+	}
+	visited[key] = true
+	defer delete(visited, key)
+
+	var result []sourceLine
+	lines := strings.Split(normalizeSource(source), "\n")
+	for i, line := range lines {
+		matches := includeRe.FindStringSubmatch(strings.TrimRight(codePart(line), " \t"))
+		if matches == nil {
+			result = append(result, sourceLine{sourcePos{file, i + 1}, line})
+			continue
+		}
+
+		asmState.file = file
+		asmState.line = i + 1
+		asmState.column = 0
+		if matches[1] != "" {
+			return nil, errorCasl2(asmState, fmt.Sprintf("Can't use label \"%s\" at INCLUDE", matches[1]))
+		}
+		opr := strings.TrimSpace(matches[3])
+		if len(opr) < 3 || !strings.HasPrefix(opr, "'") || !strings.HasSuffix(opr, "'") {
+			return nil, errorCasl2(asmState, fmt.Sprintf("Invalid operand \"%s\"", opr))
+		}
+
+		includePath := opr[1 : len(opr)-1]
+		if !filepath.IsAbs(includePath) {
+			includePath = filepath.Join(filepath.Dir(file), includePath)
+		}
+		includeKey := filepath.Clean(includePath)
+		if abs, err := filepath.Abs(includePath); err == nil {
+			includeKey = abs
+		}
+		if visited[includeKey] {
+			return nil, errorCasl2(asmState, fmt.Sprintf("Recursive INCLUDE of \"%s\"", opr[1:len(opr)-1]))
+		}
+
+		content, err := ioutil.ReadFile(includePath)
+		if err != nil {
+			return nil, errorCasl2(asmState, fmt.Sprintf("Cannot read file: %v", err))
+		}
+		included, err := expandIncludes(asmState, string(content), includePath, visited)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, included...)
+	}
+
+	return result, nil
+}
+
+func pass2(asmState *AssemblerState) ([]uint16, error) {
+	lastPos := sourcePos{Line: -1}
+	lastFile := asmState.mainFile
+
+	// Lines without code (labels alone, START, END, comments) are listed in
+	// source order between the code lines
+	lineIndex := make(map[sourcePos]int)
+	for i, pos := range asmState.order {
+		lineIndex[pos] = i
+	}
+	nextLine := 0
+	listPlainLines := func(upTo int) {
+		for ; nextLine < upTo; nextLine++ {
+			pos := asmState.order[nextLine]
+			if pos.File != lastFile {
+				asmState.outdump = append(asmState.outdump, fmt.Sprintf("[%s]", pos.File))
+				lastFile = pos.File
+			}
+			line := strings.TrimRight(listingSource(asmState, pos), "\t")
+			asmState.outdump = append(asmState.outdump, fmt.Sprintf("%4d %9s\t%s", pos.Line, "", line))
+		}
+	}
+
+	// Sort memory addresses
+	var addresses []int
+	for addr := range asmState.memory {
+		if addr >= 0 {
+			addresses = append(addresses, addr)
+		}
+	}
+
+	sort.Ints(addresses)
+
+	comet2bin := make([]uint16, 0)
+	for _, address := range addresses {
+		// Fill the gap left by ORG
+		for len(comet2bin) < address {
+			comet2bin = append(comet2bin, 0)
+		}
+		memEntry := asmState.memory[address]
+		asmState.file = memEntry.File
+		asmState.line = memEntry.Line
+		pos := sourcePos{memEntry.File, memEntry.Line}
+
+		val, ok := resolveLabel(asmState.symtbl, memEntry.Val)
+		if !ok {
+			label := fmt.Sprint(memEntry.Val)
+			if base, _, ok := splitLabelOffset(label); ok {
+				label = base
+			}
+			label = label[strings.LastIndex(label, ":")+1:]
+			asmState.column = labelColumn(asmState, pos, label)
+			if err := lineError(asmState, errorCasl2(asmState, fmt.Sprintf("Undefined label \"%s\"", label))); err != nil {
+				return nil, err
+			}
+		}
+		comet2bin = append(comet2bin, uint16(val))
+
+		if asmState.Listing {
+			line := listingSource(asmState, pos)
+			if idx, ok := lineIndex[pos]; ok && pos != lastPos && idx >= nextLine {
+				listPlainLines(idx)
+				nextLine = idx + 1
+			}
+
+			// Mark where code from an included file starts and ends
+			if memEntry.File != lastFile {
+				asmState.outdump = append(asmState.outdump, fmt.Sprintf("[%s]", memEntry.File))
+				lastFile = memEntry.File
+			}
+
+			if pos != lastPos {
+				str := fmt.Sprintf("%4d %s %s\t%s", asmState.line, hex(address, 4), hex(val, 4), line)
+				asmState.outdump = append(asmState.outdump, str)
+				lastPos = pos
+			} else {
+				str := fmt.Sprintf("%4d      %s", asmState.line, hex(val, 4))
+				asmState.outdump = append(asmState.outdump, str)
+			}
+		}
+	}
+
+	if asmState.Listing {
+		listPlainLines(len(asmState.order))
+		asmState.outdump = append(asmState.outdump, "\nDEFINED SYMBOLS")
+
+		// Sort symbols by line
+		type symInfo struct {
+			name string
+			file string
+			line int
+		}
+		var symbols []symInfo
+		for name, entry := range asmState.symtbl {
+			if !strings.HasPrefix(name, "=") {
+				symbols = append(symbols, symInfo{name, entry.File, entry.Line})
+			}
+		}
+
+		// Sort by line
+		sort.Slice(symbols, func(i, j int) bool {
+			if symbols[i].line != symbols[j].line {
+				return symbols[i].line < symbols[j].line
+			}
+			return symbols[i].name < symbols[j].name
+		})
+
+		for _, sym := range symbols {
+			label := sym.name
+			re := regexp.MustCompile(`^([a-zA-Z\$%_\.][0-9a-zA-Z\$%_\.]*):([a-zA-Z\$%_\.][0-9a-zA-Z\$%_\.]*)$`)
+			if matches := re.FindStringSubmatch(label); matches != nil {
+				var labelView string
+				if matches[1] == matches[2] {
+					labelView = matches[2]
+				} else {
+					labelView = fmt.Sprintf("%s (%s)", matches[2], matches[1])
+				}
+				val := expandLabel(asmState.symtbl, label)
+				where := strconv.Itoa(sym.line)
+				if sym.file != asmState.mainFile {
+					where = sym.file + ":" + where
+				}
+				asmState.outdump = append(asmState.outdump, fmt.Sprintf("%s:\t%s\t%s", where, hex(val, 4), labelView))
+			}
+		}
+
+	}
+
+	return comet2bin, nil
+}
+
+// Helper functions
+
+var scopedLabelRe = regexp.MustCompile(`:([a-zA-Z\$%_\.][0-9a-zA-Z\$%_\.]*)$`)
+
+// listingSource returns the source line at pos as shown in listings, with
+// the scope removed from its label
+func listingSource(asmState *AssemblerState, pos sourcePos) string {
+	bufLine := strings.Split(asmState.buf[pos], "\t")
+	if len(bufLine) > 0 {
+		if matches := scopedLabelRe.FindStringSubmatch(bufLine[0]); matches != nil {
+			bufLine[0] = matches[1]
+		}
+	}
+	return strings.Join(bufLine, "\t")
+}
+
+// normalizeSpaces replaces full-width spaces outside quotes with ASCII spaces
+// so that they separate fields like ordinary blanks
+func normalizeSpaces(line string) string {
+	if !strings.Contains(line, "\u3000") {
+		return line
+	}
+	var b strings.Builder
+	inQuote := false
+	for _, r := range line {
+		if r == '\'' {
+			inQuote = !inQuote
+		} else if r == '\u3000' && !inQuote {
+			r = ' '
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// normalizeSource drops a UTF-8 BOM and converts CRLF and CR line endings to LF
+func normalizeSource(source string) string {
+	source = strings.TrimPrefix(source, "\ufeff")
+	source = strings.ReplaceAll(source, "\r\n", "\n")
+	return strings.ReplaceAll(source, "\r", "\n")
+}
+
+func parseOperands(opr string) []string {
+	var result []string
+	var current strings.Builder
+	inQuote := false
+
+	for i := 0; i < len(opr); i++ {
+		ch := opr[i]
+
+		if ch == '\'' {
+			if inQuote && i+1 < len(opr) && opr[i+1] == '\'' {
+				current.WriteByte(ch)
+				current.WriteByte(ch)
+				i++
+			} else {
+				inQuote = !inQuote
+				current.WriteByte(ch)
+			}
+		} else if ch == ',' && !inQuote {
+			result = append(result, strings.TrimSpace(current.String()))
+			current.Reset()
+		} else {
+			current.WriteByte(ch)
+		}
+	}
+
+	if current.Len() > 0 {
+		result = append(result, strings.TrimSpace(current.String()))
+	}
+
+	return result
+}
+
+// stripTrailingComment cuts free-form text after an operand list: the list
+// ends at whitespace outside quotes that is neither before nor after a comma
+func stripTrailingComment(opr string) string {
+	inQuote := false
+	for i := 0; i < len(opr); i++ {
+		switch ch := opr[i]; {
+		case ch == '\'':
+			inQuote = !inQuote
+		case !inQuote && (ch == ' ' || ch == '\t'):
+			before := strings.TrimRight(opr[:i], " \t")
+			after := strings.TrimLeft(opr[i:], " \t")
+			if after != "" && after[0] != ',' && !strings.HasSuffix(before, ",") {
+				return before
+			}
+		}
+	}
+	return opr
+}
+
+func isLabel(s string) bool {
+	matched, _ := regexp.MatchString(`^[a-zA-Z\$%_\.][0-9a-zA-Z\$%_\.]*$`, s)
+	return matched
+}
+
+var labelOffsetRe = regexp.MustCompile(`^(.+?)([+-])(\d+|#[\da-fA-F]+)$`)
+
+// splitLabelOffset splits an operand of the form LABEL+N or LABEL-N, where
+// N is decimal or #hex, into the label and the signed offset
+func splitLabelOffset(s string) (string, int, bool) {
+	matches := labelOffsetRe.FindStringSubmatch(s)
+	if matches == nil {
+		return "", 0, false
+	}
+	var num int64
+	var err error
+	if strings.HasPrefix(matches[3], "#") {
+		num, err = strconv.ParseInt(matches[3][1:], 16, 64)
+	} else {
+		num, err = strconv.ParseInt(matches[3], 10, 64)
+	}
+	if err != nil || num > 0xffff {
+		return "", 0, false
+	}
+	if matches[2] == "-" {
+		num = -num
+	}
+	return matches[1], int(num), true
+}
+
+// isLabelOffset reports whether s is a LABEL+N or LABEL-N operand
+func isLabelOffset(s string) bool {
+	base, _, ok := splitLabelOffset(s)
+	return ok && isLabel(base) && !isRegister(base)
+}
+
+func isRegister(s string) bool {
+	matched, _ := regexp.MatchString(`^GR[0-7]$`, strings.ToUpper(s))
+	return matched
+}
+
+// decodeString returns the character codes of the contents of a quoted
+// string, resolving doubled quotes and the escapes \n, \t, \0 and \\
+func decodeString(str string) []int {
+	var codes []int
+	chars := []rune(str)
+	for i := 0; i < len(chars); i++ {
+		ch := chars[i]
+		if ch == '\'' && i+1 < len(chars) && chars[i+1] == '\'' {
+			i++
+		} else if ch == '\\' && i+1 < len(chars) {
+			switch chars[i+1] {
+			case 'n':
+				ch = '\n'
+				i++
+			case 't':
+				ch = '\t'
+				i++
+			case '0':
+				ch = 0
+				i++
+			case '\\':
+				i++
+			}
+		}
+		codes = append(codes, int(ch))
+	}
+	return codes
+}
+
+// handleLiteral returns the symbol for lit, reusing the one already
+// allocated for the same spelling in the current program
+func handleLiteral(lit string, stack *[]string, names map[string]string, counter *int) string {
+	if name, ok := names[lit]; ok {
+		return name
+	}
+	newLit := fmt.Sprintf("%s_%d", lit, *counter)
+	*stack = append(*stack, newLit)
+	names[lit] = newLit
+	*counter++
+	return newLit
+}
+
+func checkLabel(asmState *AssemblerState, label string) error {
+	if !isLabel(label) {
+		return errorCasl2(asmState, fmt.Sprintf("Invalid label \"%s\"", label))
+	}
+	return nil
+}
+
+func addLabel(asmState *AssemblerState, label string, val int) error {
+	if err := checkLabel(asmState, label); err != nil {
+		return err
+	}
+
+	uniqLabel := asmState.varScope + ":" + label
+	if _, exists := asmState.symtbl[uniqLabel]; exists {
+		return errorCasl2(asmState, fmt.Sprintf("Label \"%s\" has already defined", label))
+	}
+
+	asmState.symtbl[uniqLabel] = &symbolEntry{
+		Val:  val,
+		File: asmState.file,
+		Line: asmState.line,
+	}
+
+	return nil
+}
+
+func updateLabel(asmState *AssemblerState, label string, val int) error {
+	if err := checkLabel(asmState, label); err != nil {
+		return err
+	}
+
+	uniqLabel := asmState.varScope + ":" + label
+	if _, exists := asmState.symtbl[uniqLabel]; !exists {
+		return errorCasl2(asmState, fmt.Sprintf("Label \"%s\" is not defined", label))
+	}
+
+	asmState.symtbl[uniqLabel] = &symbolEntry{
+		Val:  val,
+		File: asmState.file,
+		Line: asmState.line,
+	}
+
+	return nil
+}
+
+var binaryRe = regexp.MustCompile(`^(=?)%([01]+)$`)
+
+// binaryToHex rewrites a %binary operand or literal as #hex and returns
+// any other operand unchanged
+func binaryToHex(asmState *AssemblerState, op string) (string, error) {
+	matches := binaryRe.FindStringSubmatch(op)
+	if matches == nil {
+		return op, nil
+	}
+	if len(matches[2]) > 16 {
+		return "", errorCasl2(asmState, fmt.Sprintf("\"%s\" is out of range", strings.TrimPrefix(op, "=")))
+	}
+	num, _ := strconv.ParseInt(matches[2], 2, 64)
+	return matches[1] + "#" + hex(int(num), 4), nil
+}
+
+// parseConstant parses a decimal (-32768..65535) or #hex (up to 4 digits)
+// constant into a 16-bit word
+func parseConstant(asmState *AssemblerState, op string) (int, error) {
+	var num int64
+	var err error
+	if strings.HasPrefix(op, "#") {
+		if len(op) > 5 {
+			return 0, errorCasl2(asmState, fmt.Sprintf("\"%s\" is out of range", op))
+		}
+		num, err = strconv.ParseInt(op[1:], 16, 64)
+	} else {
+		num, err = strconv.ParseInt(op, 10, 64)
+	}
+	if err != nil {
+		return 0, errorCasl2(asmState, fmt.Sprintf("Invalid value \"%s\"", op))
+	}
+	if num < MIN_SIGNED || num > 0xffff {
+		return 0, errorCasl2(asmState, fmt.Sprintf("\"%s\" is out of range", op))
+	}
+	return int(num) & 0xffff, nil
+}
+
+// lookupLabel resolves a label already defined in the current scope
+func lookupLabel(asmState *AssemblerState, label string) (int, bool) {
+	if !isLabel(label) {
+		return 0, false
+	}
+	if _, exists := asmState.symtbl[asmState.varScope+":"+label]; !exists {
+		return 0, false
+	}
+	asmState.refs[asmState.varScope+":"+label] = true
+	return expandLabel(asmState.symtbl, asmState.varScope+":"+label), true
+}
+
+// UnusedLabel is a label that is defined but never referenced
+type UnusedLabel struct {
+	Label string
+	File  string
+	Line  int
+}
+
+// UnusedLabels returns the labels that are defined but never referenced,
+// by line. START labels are module entries and are not reported.
+func (asmState *AssemblerState) UnusedLabels() []UnusedLabel {
+	refs := make(map[string]bool)
+	for name := range asmState.refs {
+		refs[name] = true
+	}
+	for _, entry := range asmState.memory {
+		v, ok := entry.Val.(string)
+		if !ok {
+			continue
+		}
+		if base, _, ok := splitLabelOffset(v); ok {
+			v = base
+		}
+		if _, exists := asmState.symtbl[v]; exists {
+			refs[v] = true
+		} else if strings.HasPrefix(v, "CALL_") {
+			lbl := v[5:]
+			if _, exists := asmState.symtbl[lbl]; exists {
+				refs[lbl] = true
+			} else if idx := strings.Index(lbl, ":"); idx >= 0 {
+				refs[lbl[idx+1:]+":"+lbl[idx+1:]] = true
+			}
+		}
+	}
+
+	var labels []UnusedLabel
+	for name, entry := range asmState.symtbl {
+		idx := strings.Index(name, ":")
+		if strings.HasPrefix(name, "=") || idx < 0 || refs[name] {
+			continue
+		}
+		scope, label := name[:idx], name[idx+1:]
+		if scope == label {
+			continue
+		}
+		labels = append(labels, UnusedLabel{label, entry.File, entry.Line})
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].Line != labels[j].Line {
+			return labels[i].Line < labels[j].Line
+		}
+		return labels[i].Label < labels[j].Label
+	})
+	return labels
+}
+
+func addLiteral(asmState *AssemblerState, literal string, val int) {
+	asmState.symtbl[literal] = &symbolEntry{
+		Val:  val,
+		File: asmState.file,
+		Line: asmState.line,
+	}
+}
+
+func expandLabel(symtbl map[string]*symbolEntry, val interface{}) int {
+	num, _ := resolveLabel(symtbl, val)
+	return num
+}
+
+// resolveLabel is like expandLabel but reports whether val could be resolved
+func resolveLabel(symtbl map[string]*symbolEntry, val interface{}) (int, bool) {
+	switch v := val.(type) {
+	case int:
+		return v & 0xffff, true
+	case string:
+		// Check if it's a hex number
+		if strings.HasPrefix(v, "#") {
+			num, err := strconv.ParseInt(v[1:], 16, 64)
+			if err == nil {
+				return int(num) & 0xffff, true
+			}
+		}
+
+		// Check if it's in symbol table
+		if entry, exists := symtbl[v]; exists {
+			return resolveLabel(symtbl, entry.Val)
+		}
+
+		// Check for CALL_ prefix
+		if strings.HasPrefix(v, "CALL_") {
+			lbl := v[5:]
+			if entry, exists := symtbl[lbl]; exists {
+				return resolveLabel(symtbl, entry.Val)
+			}
+
+			// Try with scope
+			re := regexp.MustCompile(`:([a-zA-Z\$%_\.][0-9a-zA-Z\$%_\.]*)$`)
+			if matches := re.FindStringSubmatch(v); matches != nil {
+				k := matches[1] + ":" + matches[1]
+				if entry, exists := symtbl[k]; exists {
+					return resolveLabel(symtbl, entry.Val)
+				}
+			}
+		}
+
+		// Try to parse as decimal
+		if num, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return int(num) & 0xffff, true
+		}
+
+		// Check for LABEL+N or LABEL-N
+		if base, offset, ok := splitLabelOffset(v); ok {
+			if num, ok := resolveLabel(symtbl, base); ok {
+				return (num + offset) & 0xffff, true
+			}
+		}
+
+		// If all else fails, return 0
+		return 0, false
+	default:
+		return 0, false
+	}
+}
+
+func checkRegister(register string) (int, error) {
+	re := regexp.MustCompile(`^(GR)?([0-7])$`)
+	matches := re.FindStringSubmatch(strings.ToUpper(register))
+	if matches == nil {
+		return 0, fmt.Errorf("Invalid register \"%s\"", register)
+	}
+	num, _ := strconv.Atoi(matches[2])
+	return num, nil
+}
+
+func genCode1(memory map[int]*memoryEntry, address int, val interface{}, asmState *AssemblerState) {
+	switch v := val.(type) {
+	case int:
+		memory[address] = &memoryEntry{Val: v, File: asmState.file, Line: asmState.line}
+	case string:
+		// Check for hex
+		if strings.HasPrefix(v, "#") {
+			if num, err := strconv.ParseInt(v[1:], 16, 64); err == nil {
+				memory[address] = &memoryEntry{Val: int(num), File: asmState.file, Line: asmState.line}
+				return
+			}
+		}
+		// Check for decimal
+		if num, err := strconv.ParseInt(v, 10, 64); err == nil {
+			memory[address] = &memoryEntry{Val: int(num), File: asmState.file, Line: asmState.line}
+			return
+		}
+		// Store as string (will be resolved in pass2)
+		memory[address] = &memoryEntry{Val: v, File: asmState.file, Line: asmState.line}
+	}
+}
+
+func genCode2(memory map[int]*memoryEntry, address int, code int, gr, adr, xr string, asmState *AssemblerState) error {
+	ngr, err := checkRegister(gr)
+	if err != nil {
+		return errorCasl2(asmState, err.Error())
+	}
+	nxr, err := checkRegister(xr)
+	if err != nil {
+		return errorCasl2(asmState, err.Error())
+	}
+
+	val := (code << 8) + (ngr << 4) + nxr
+	memory[address] = &memoryEntry{Val: val, File: asmState.file, Line: asmState.line, Code: true}
+
+	// Handle address operand
+	if strings.HasPrefix(adr, "#") {
+		if num, err := strconv.ParseInt(adr[1:], 16, 64); err == nil {
+			memory[address+1] = &memoryEntry{Val: int(num), File: asmState.file, Line: asmState.line, Operand: true}
+			return nil
+		}
+	}
+
+	memory[address+1] = &memoryEntry{Val: adr, File: asmState.file, Line: asmState.line, Operand: true}
+	return nil
+}
+
+func genCode3(memory map[int]*memoryEntry, address int, code int, gr1, gr2 string, asmState *AssemblerState) error {
+	ngr1, err := checkRegister(gr1)
+	if err != nil {
+		return errorCasl2(asmState, err.Error())
+	}
+	ngr2, err := checkRegister(gr2)
+	if err != nil {
+		return errorCasl2(asmState, err.Error())
+	}
+
+	val := (code << 8) + (ngr1 << 4) + ngr2
+	memory[address] = &memoryEntry{Val: val, File: asmState.file, Line: asmState.line, Code: true}
+	return nil
+}
+
+// syntaxError returns the error ParseLine finds in line, located by column,
+// or nil if the lexer accepts the line
+func syntaxError(asmState *AssemblerState, line string) error {
+	_, err := ParseLine(line, asmState.line)
+	var synErr *SyntaxError
+	if !errors.As(err, &synErr) {
+		return nil
+	}
+	return errorCasl2At(asmState, synErr.Column, synErr.Msg)
+}
+
+// errorCasl2 reports msg at the field of the current line being assembled;
+// the column goes to -diagnostics but not into the message
+func errorCasl2(asmState *AssemblerState, msg string) error {
+	return &AsmError{
+		File:        asmState.file,
+		Line:        asmState.line,
+		Column:      asmState.column,
+		Msg:         msg,
+		mainFile:    asmState.file == asmState.mainFile,
+		fieldColumn: true,
+	}
+}
+
+// sourceColumn returns the 1-based column of the byte offset i in line
+func sourceColumn(line string, i int) int {
+	return utf8.RuneCountInString(line[:i]) + 1
+}
+
+// labelColumn returns the column of label in the operands of the line at
+// pos, or 0 if it is not found there
+func labelColumn(asmState *AssemblerState, pos sourcePos, label string) int {
+	field, ok := asmState.operands[pos]
+	if !ok {
+		return 0
+	}
+	idx := strings.Index(field.Text, label)
+	if idx < 0 {
+		return 0
+	}
+	return field.Column + utf8.RuneCountInString(field.Text[:idx])
+}
+
+// errorCasl2At is errorCasl2 for an error at a known column (0 if unknown)
+func errorCasl2At(asmState *AssemblerState, col int, msg string) error {
+	return &AsmError{
+		File:     asmState.file,
+		Line:     asmState.line,
+		Column:   col,
+		Msg:      msg,
+		mainFile: asmState.file == asmState.mainFile,
+	}
+}
+
+// AsmError is an assembly error located in the source
+type AsmError struct {
+	File   string
+	Line   int
+	Column int
+	Msg    string
+	// Errors in the main file are shown without its name
+	mainFile bool
+	// Column is that of the whole field, which the message leaves out
+	fieldColumn bool
+}
+
+func (e *AsmError) Error() string {
+	where := fmt.Sprintf("Line %d", e.Line)
+	if e.Column > 0 && !e.fieldColumn {
+		where += fmt.Sprintf(", col %d", e.Column)
+	}
+	if !e.mainFile {
+		where = e.File + ": " + where
+	}
+	return where + ": " + e.Msg
+}
+
+// lineError returns err to stop the assembly, or records it in errs and
+// returns nil when KeepGoing asks for every error at once
+func lineError(asmState *AssemblerState, err error) error {
+	if !asmState.KeepGoing {
+		return err
+	}
+	asmState.errs = append(asmState.errs, err)
+	return nil
+}
+
+// instructionSize returns the number of words generated by an instruction
+// or macro, or 0 for assembler instructions whose size depends on operands
+func instructionSize(instType instructionType, oprArray []string) int {
+	switch instType {
+	case op1, op2:
+		return 2
+	case op3, op4:
+		return 1
+	case op5:
+		if len(oprArray) > 1 && isRegister(oprArray[1]) {
+			return 1
+		}
+		return 2
+	case opIN, opOUT:
+		return 12
+	case opRPUSH:
+		return 14
+	case opRPOP:
+		return 7
+	}
+	return 0
+}
@@ -0,0 +1,961 @@
+package comet2
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// assembleSource writes source to a temporary file and assembles it
+func assembleSource(t *testing.T, source string) ([]uint16, uint16, *AssemblerState, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.cas")
+	if err := os.WriteFile(path, []byte(source), 0644); err != nil {
+		t.Fatalf("Failed to write source: %v", err)
+	}
+	asmState := NewAssemblerState()
+	bin, start, err := AssembleFile(path, asmState)
+	return bin, start, asmState, err
+}
+
+func TestListingAddressesAscending(t *testing.T) {
+	var src strings.Builder
+	src.WriteString("MAIN\tSTART\n")
+	for i := 0; i < 5000; i++ {
+		src.WriteString("\tNOP\n")
+	}
+	src.WriteString("\tRET\n\tEND\n")
+
+	asmState := NewAssemblerState()
+	asmState.Listing = true
+	bin, _, err := assembleText(src.String(), "test.cas", asmState)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	if len(bin) != 5001 {
+		t.Fatalf("len(bin) = %d, want 5001", len(bin))
+	}
+
+	last := -1
+	for _, line := range asmState.outdump {
+		if strings.Contains(line, "DEFINED SYMBOLS") {
+			break
+		}
+		// Skip operand words and lines without code
+		fields := strings.Fields(line)
+		if len(fields) < 3 || strings.TrimSpace(line[5:9]) == "" {
+			continue
+		}
+		addr, err := strconv.ParseInt(fields[1], 16, 64)
+		if err != nil {
+			t.Fatalf("Unexpected listing line %q", line)
+		}
+		if int(addr) <= last {
+			t.Fatalf("Listing address #%s follows #%s", fields[1], hex(last, 4))
+		}
+		last = int(addr)
+	}
+	if last != 5000 {
+		t.Errorf("Last listing address = #%s, want #1388", hex(last, 4))
+	}
+}
+
+func TestListingPlainLines(t *testing.T) {
+	src := `MAIN	START
+	LAD	GR1, 3
+; count down
+LOOP
+	SUBA	GR1, =1	; next
+
+	JNZ	LOOP
+	RET
+	END
+`
+	asmState := NewAssemblerState()
+	asmState.Listing = true
+	if _, _, err := assembleText(src, "test.cas", asmState); err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+
+	want := []string{
+		"   1          \tMAIN\tSTART",
+		"   2 0000 1210\t\tLAD\tGR1, 3",
+		"   2      0003",
+		"   3          \t\t; count down",
+		"   4          \tLOOP",
+		"   5 0002 2110\t\tSUBA\tGR1, =1",
+		"   5      0007",
+		"   7 0004 6200\t\tJNZ\tLOOP",
+		"   7      0002",
+		"   8 0006 8100\t\tRET\t",
+		"   9 0007 0001\t\tEND\t",
+	}
+	got := asmState.outdump
+	if len(got) > len(want) {
+		got = got[:len(want)]
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listing =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestEQU(t *testing.T) {
+	src := `MAIN	START
+BUFLEN	EQU	256
+MASK	EQU	#00FF
+ALIAS	EQU	BUFLEN
+	LAD	GR1, BUFLEN
+	RET
+SIZE	DC	BUFLEN, MASK, ALIAS
+BUF	DS	BUFLEN
+	END
+`
+	bin, _, asmState, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	if len(bin) != 2+1+3+256 {
+		t.Fatalf("len(bin) = %d, want %d", len(bin), 2+1+3+256)
+	}
+	if bin[1] != 256 {
+		t.Errorf("LAD operand = #%s, want #0100", hex(int(bin[1]), 4))
+	}
+	if bin[3] != 256 || bin[4] != 0xff || bin[5] != 256 {
+		t.Errorf("DC words = %v, want [256 255 256]", bin[3:6])
+	}
+	if got := expandLabel(asmState.symtbl, "MAIN:BUF"); got != 6 {
+		t.Errorf("BUF = #%s, want #0006", hex(got, 4))
+	}
+
+	_, _, _, err = assembleSource(t, "MAIN\tSTART\nX\tEQU\tUNDEF\n\tRET\n\tEND\n")
+	if err == nil || !strings.Contains(err.Error(), "Undefined symbol") {
+		t.Errorf("Expected undefined symbol error, got %v", err)
+	}
+
+	// A label that fails to register must not be bound to the value
+	_, _, _, err = Assemble("MAIN\tSTART\n1X\tEQU\t5\n\tRET\n\tEND\n")
+	if err == nil || !strings.Contains(err.Error(), "Line 2: Invalid label \"1X\"") {
+		t.Errorf("Expected invalid label error, got %v", err)
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir := t.TempDir()
+	lib := `LIB	START
+	LAD	GR1, 1
+	RET
+	END
+`
+	main := `MAIN	START
+	CALL	LIB
+	RET
+	END
+	INCLUDE	'lib.cas'
+`
+	if err := os.WriteFile(filepath.Join(dir, "lib.cas"), []byte(lib), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mainPath := filepath.Join(dir, "main.cas")
+	if err := os.WriteFile(mainPath, []byte(main), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	asmState := NewAssemblerState()
+	bin, _, err := AssembleFile(mainPath, asmState)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	if len(bin) != 6 {
+		t.Fatalf("len(bin) = %d, want 6", len(bin))
+	}
+	if bin[1] != 3 {
+		t.Errorf("CALL target = #%s, want #0003", hex(int(bin[1]), 4))
+	}
+	entry := asmState.symtbl["LIB:LIB"]
+	if entry == nil || entry.File != filepath.Join(dir, "lib.cas") || entry.Line != 1 {
+		t.Errorf("LIB symbol = %+v, want lib.cas line 1", entry)
+	}
+	if mem := asmState.memory[3]; mem.File != filepath.Join(dir, "lib.cas") || mem.Line != 2 {
+		t.Errorf("memory[3] from %s:%d, want lib.cas:2", mem.File, mem.Line)
+	}
+}
+
+func TestIncludeCommentAndCase(t *testing.T) {
+	dir := t.TempDir()
+	lib := "LIB\tSTART\n\tRET\n\tEND\n"
+	main := `MAIN	START
+	CALL	LIB
+	RET
+	END
+; INCLUDE	'missing.cas'
+	include	'lib.cas'	; the library
+`
+	if err := os.WriteFile(filepath.Join(dir, "lib.cas"), []byte(lib), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mainPath := filepath.Join(dir, "main.cas")
+	if err := os.WriteFile(mainPath, []byte(main), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bin, _, err := AssembleFile(mainPath, NewAssemblerState())
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	if len(bin) != 4 {
+		t.Errorf("len(bin) = %d, want 4", len(bin))
+	}
+}
+
+func TestIncludeCycle(t *testing.T) {
+	dir := t.TempDir()
+	src := "MAIN\tSTART\n\tRET\n\tEND\n\tINCLUDE\t'self.cas'\n"
+	path := filepath.Join(dir, "self.cas")
+	if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err := AssembleFile(path, NewAssemblerState())
+	if err == nil || !strings.Contains(err.Error(), "Recursive INCLUDE") {
+		t.Errorf("Expected recursive include error, got %v", err)
+	}
+}
+
+func TestDCNumbers(t *testing.T) {
+	src := `MAIN	START
+	RET
+	DC	-1
+	DC	#ffff
+	DC	65535
+	DC	-32768
+	DC	1, -2, #3
+	END
+`
+	bin, _, _, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	want := []uint16{0x8100, 0xffff, 0xffff, 0xffff, 0x8000, 0x0001, 0xfffe, 0x0003}
+	if len(bin) != len(want) {
+		t.Fatalf("len(bin) = %d, want %d", len(bin), len(want))
+	}
+	for i := range want {
+		if bin[i] != want[i] {
+			t.Errorf("word %d = #%s, want #%s", i, hex(int(bin[i]), 4), hex(int(want[i]), 4))
+		}
+	}
+
+	for _, op := range []string{"65536", "-32769", "#10000", "12x"} {
+		_, _, _, err := assembleSource(t, "MAIN\tSTART\n\tDC\t"+op+"\n\tEND\n")
+		if err == nil {
+			t.Errorf("DC %s: expected error", op)
+		}
+	}
+}
+
+func TestStringEscapes(t *testing.T) {
+	src := `MAIN	START
+	LD	GR1, ='\t'
+	RET
+	DC	'A\nB'
+	DC	'\\''\0'
+	END
+`
+	bin, _, _, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	// The one-character literal ='\t' is a single word
+	want := []uint16{0x1010, 0x000b, 0x8100, 65, 10, 66, 0, '\\', '\'', 0, 0, '\t'}
+	if len(bin) != len(want) {
+		t.Fatalf("bin = %v, want %v", bin, want)
+	}
+	for i := range want {
+		if bin[i] != want[i] {
+			t.Errorf("word %d = %d, want %d", i, bin[i], want[i])
+		}
+	}
+}
+
+func TestNumericLiterals(t *testing.T) {
+	src := `MAIN	START
+	LD	GR1, =5
+	LD	GR2, =#10
+	LD	GR3, =-1
+	RET
+	END
+`
+	bin, _, _, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	want := []uint16{0x1010, 7, 0x1020, 8, 0x1030, 9, 0x8100, 5, 0x10, 0xffff}
+	if len(bin) != len(want) {
+		t.Fatalf("bin = %v, want %v", bin, want)
+	}
+	for i := range want {
+		if bin[i] != want[i] {
+			t.Errorf("word %d = #%s, want #%s", i, hex(int(bin[i]), 4), hex(int(want[i]), 4))
+		}
+	}
+}
+
+func TestAddressOverflow(t *testing.T) {
+	_, _, _, err := assembleSource(t, "MAIN\tSTART\n\tRET\n\tDS\t70000\n\tEND\n")
+	if err == nil || !strings.Contains(err.Error(), "Line 3: Program exceeds 64K address space") {
+		t.Errorf("Expected address space error, got %v", err)
+	}
+
+	// Literals expanded at END can push the program over the limit too
+	_, _, _, err = assembleSource(t, "MAIN\tSTART\n\tLD\tGR1, =1\n\tDS\t65534\n\tEND\n")
+	if err == nil || !strings.Contains(err.Error(), "Line 4: Program exceeds 64K address space") {
+		t.Errorf("Expected address space error at END, got %v", err)
+	}
+
+	// Exactly filling the address space is fine
+	bin, _, _, err := assembleSource(t, "MAIN\tSTART\n\tRET\n\tDS\t65535\n\tEND\n")
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	if len(bin) != MEMORY_SIZE {
+		t.Errorf("len(bin) = %d, want %d", len(bin), MEMORY_SIZE)
+	}
+}
+
+func TestUnusedLabels(t *testing.T) {
+	src := `MAIN	START
+	LD	GR1, USED
+	RET
+USED	DC	1
+UNUSED	DC	2
+	END
+`
+	_, _, asmState, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+
+	labels := asmState.UnusedLabels()
+	want := UnusedLabel{Label: "UNUSED", File: asmState.MainFile(), Line: 5}
+	if len(labels) != 1 || labels[0] != want {
+		t.Errorf("UnusedLabels() = %+v, want [%+v]", labels, want)
+	}
+}
+
+func TestUndefinedLabel(t *testing.T) {
+	_, _, _, err := assembleSource(t, "MAIN\tSTART\n\tJUMP\tNOWHERE\n\tRET\n\tEND\n")
+	if err == nil || !strings.Contains(err.Error(), "Line 2: Undefined label \"NOWHERE\"") {
+		t.Errorf("Expected undefined label error, got %v", err)
+	}
+
+	// Literals, scoped labels and CALLs to other modules are resolved
+	src := `MAIN	START
+	LD	GR1, =1
+	LD	GR2, DATA
+	CALL	SUB
+	RET
+DATA	DC	2
+	END
+SUB	START
+	RET
+	END
+`
+	if _, _, _, err := assembleSource(t, src); err != nil {
+		t.Errorf("assemble failed: %v", err)
+	}
+}
+
+func TestLowercaseMnemonics(t *testing.T) {
+	upper := `MAIN	START
+	RPUSH
+	LD	GR0, =1
+	LAD	GR1, DATA, GR2
+	ADDA	GR1, GR0
+	OUT	DATA, LEN
+	RPOP
+	RET
+DATA	DC	'ok'
+LEN	DC	2
+	END
+`
+	lower := `MAIN	start
+	rpush
+	ld	gr0, =1
+	lad	gr1, DATA, gr2
+	adda	gr1, gr0
+	out	DATA, LEN
+	rpop
+	ret
+DATA	dc	'ok'
+LEN	dc	2
+	end
+`
+	want, _, _, err := assembleSource(t, upper)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	got, _, _, err := assembleSource(t, lower)
+	if err != nil {
+		t.Fatalf("assemble lowercase failed: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("len = %d, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("word %d = #%s, want #%s", i, hex(int(got[i]), 4), hex(int(want[i]), 4))
+		}
+	}
+
+	// Labels stay case-sensitive
+	_, _, _, err = assembleSource(t, "MAIN\tSTART\n\tld\tgr1, data\n\tret\nDATA\tdc\t1\n\tend\n")
+	if err == nil || !strings.Contains(err.Error(), "Undefined label \"data\"") {
+		t.Errorf("Expected undefined label error, got %v", err)
+	}
+}
+
+func TestLabelOffset(t *testing.T) {
+	src := `MAIN	START
+	LAD	GR1, BUF-1
+	LD	GR2, TABLE+2
+	LD	GR3, TABLE+#1, GR1
+	RET
+TABLE	DC	1, 2, 3
+PTR	DC	TABLE+1
+BUF	DS	2
+	END
+`
+	bin, _, _, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	// TABLE is #0007, BUF is #000b
+	cases := []struct {
+		addr int
+		want uint16
+	}{
+		{1, 0x000a},
+		{3, 0x0009},
+		{5, 0x0008},
+		{10, 0x0008},
+	}
+	for _, c := range cases {
+		if bin[c.addr] != c.want {
+			t.Errorf("word %d = #%s, want #%s", c.addr, hex(int(bin[c.addr]), 4), hex(int(c.want), 4))
+		}
+	}
+
+	_, _, _, err = assembleSource(t, "MAIN\tSTART\n\tLAD\tGR1, NOWHERE+1\n\tRET\n\tEND\n")
+	if err == nil || !strings.Contains(err.Error(), "Line 2: Undefined label \"NOWHERE\"") {
+		t.Errorf("Expected undefined label error, got %v", err)
+	}
+}
+
+func TestORG(t *testing.T) {
+	src := `MAIN	START	BEGIN
+	RET
+	ORG	#2000
+BEGIN	LAD	GR1, DATA
+	RET
+DATA	DC	7
+	END
+`
+	bin, start, _, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	if start != 0x2000 {
+		t.Errorf("start = #%s, want #2000", hex(int(start), 4))
+	}
+	if len(bin) != 0x2004 {
+		t.Fatalf("len(bin) = #%s, want #2004", hex(len(bin), 4))
+	}
+	if bin[1] != 0 || bin[0x2001] != 0x2003 || bin[0x2003] != 7 {
+		t.Errorf("bin[1], bin[#2001], bin[#2003] = %d, #%s, %d, want 0, #2003, 7",
+			bin[1], hex(int(bin[0x2001]), 4), bin[0x2003])
+	}
+
+	_, _, _, err = assembleSource(t, "MAIN\tSTART\n\tORG\t#0010\n\tRET\n\tORG\t#0008\n\tRET\n\tEND\n")
+	if err == nil || !strings.Contains(err.Error(), "Line 4: ORG #0008 overlaps") {
+		t.Errorf("Expected overlap error, got %v", err)
+	}
+
+	_, _, _, err = assembleSource(t, "MAIN\tSTART\n\tORG\t#FFFF\n\tDC\t1, 2\n\tEND\n")
+	if err == nil || !strings.Contains(err.Error(), "Program exceeds 64K address space") {
+		t.Errorf("Expected address space error, got %v", err)
+	}
+
+	_, _, _, err = Assemble("MAIN\tSTART\n1X\tORG\t#10\n\tRET\n\tEND\n")
+	if err == nil || !strings.Contains(err.Error(), "Line 2: Invalid label \"1X\"") {
+		t.Errorf("Expected invalid label error, got %v", err)
+	}
+}
+
+func TestLiteralDedup(t *testing.T) {
+	src := `MAIN	START
+	LD	GR1, =1
+	ADDA	GR1, =1
+	SUBA	GR1, =1
+	LD	GR2, =2
+	RET
+	END
+SUB	START
+	LD	GR1, =1
+	RET
+	END
+`
+	bin, _, _, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	// MAIN: 4 two-word instructions, RET, =1, =2; SUB: LD, RET, =1
+	want := []uint16{
+		0x1010, 9, 0x2010, 9, 0x2110, 9, 0x1020, 10, 0x8100, 1, 2,
+		0x1010, 14, 0x8100, 1,
+	}
+	if len(bin) != len(want) {
+		t.Fatalf("bin = %v, want %v", bin, want)
+	}
+	for i := range want {
+		if bin[i] != want[i] {
+			t.Errorf("word %d = #%s, want #%s", i, hex(int(bin[i]), 4), hex(int(want[i]), 4))
+		}
+	}
+}
+
+func TestCharacterLiteral(t *testing.T) {
+	src := `MAIN	START
+	LD	GR1, ='A'
+	LAD	GR2, ='AB'
+	LD	GR3, ='\n'
+	RET
+	END
+`
+	bin, _, _, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	// ='A' is one word, ='AB' keeps its terminating zero
+	want := []uint16{0x1010, 7, 0x1220, 8, 0x1030, 11, 0x8100, 'A', 'A', 'B', 0, '\n'}
+	if !reflect.DeepEqual(bin, want) {
+		t.Errorf("bin = %v, want %v", bin, want)
+	}
+}
+
+func TestDSZero(t *testing.T) {
+	src := `MAIN	START
+	IN	BUF, LEN
+	LD	GR1, =1
+	RET
+LEN	DS	1
+BUF	DS	0
+	DS	4
+TAIL	DS	0
+	END
+`
+	bin, _, asmState, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	// IN is 7 words (#0000-#000b), LD #000c, RET #000e, LEN #000f
+	if got := expandLabel(asmState.symtbl, "MAIN:BUF"); got != 0x10 {
+		t.Errorf("BUF = #%s, want #0010", hex(got, 4))
+	}
+	// A trailing DS 0 names the first literal
+	if got := expandLabel(asmState.symtbl, "MAIN:TAIL"); got != 0x14 || bin[0x14] != 1 {
+		t.Errorf("TAIL = #%s holding %d, want #0014 holding 1", hex(got, 4), bin[got])
+	}
+
+	m := NewMachine(bin, 0)
+	m.In = func() string { return "ab" }
+	if err := m.Run(0); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if m.Read(0x0f) != 2 || m.Read(0x10) != 'a' || m.Read(0x11) != 'b' {
+		t.Errorf("LEN, BUF = %v, want [2 97 98]", m.Memory()[0x0f:0x12])
+	}
+
+	_, _, _, err = assembleSource(t, "MAIN\tSTART\n\tRET\n\tDS\t-1\n\tEND\n")
+	if err == nil || !strings.Contains(err.Error(), "Line 3: \"-1\" is out of range") {
+		t.Errorf("Expected range error, got %v", err)
+	}
+}
+
+func TestDSFill(t *testing.T) {
+	src := `MAIN	START
+	RET
+ONES	DS	3, #FFFF
+MINUS	EQU	-2
+NEG	DS	2, MINUS
+ZERO	DS	1
+	END
+`
+	bin, _, _, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	want := []uint16{0x8100, 0xffff, 0xffff, 0xffff, 0xfffe, 0xfffe, 0}
+	if !reflect.DeepEqual(bin, want) {
+		t.Errorf("bin = %v, want %v", bin, want)
+	}
+
+	_, _, _, err = assembleSource(t, "MAIN\tSTART\n\tRET\n\tDS\t2, #10000\n\tEND\n")
+	if err == nil || !strings.Contains(err.Error(), "\"#10000\" is out of range") {
+		t.Errorf("Expected range error, got %v", err)
+	}
+}
+
+func TestSyntaxErrorColumn(t *testing.T) {
+	cases := []struct {
+		line string
+		want string
+	}{
+		{"\tLD\tGR1,,DATA", "Line 2, col 9: unexpected token ','"},
+		{"\tLD\tGR1, DATA,", "Line 2, col 14: unexpected token ','"},
+		{"\tLD,GR1", "Line 2, col 4: unexpected token ','"},
+	}
+	for _, c := range cases {
+		_, _, _, err := assembleSource(t, "MAIN\tSTART\n"+c.line+"\n\tRET\nDATA\tDC\t1\n\tEND\n")
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: error = %v, want %q", c.line, err, c.want)
+		}
+	}
+}
+
+func TestStringLiteralWithComma(t *testing.T) {
+	src := `MAIN	START
+	LD	GR1, =','
+	RET
+PTR	DC	='a,b'
+	END
+`
+	bin, _, _, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	// LD, RET, PTR, then the literals ',' and 'a,b' with its terminator
+	want := []uint16{0x1010, 4, 0x8100, 5, ',', 'a', ',', 'b', 0}
+	if len(bin) != len(want) {
+		t.Fatalf("bin = %v, want %v", bin, want)
+	}
+	for i := range want {
+		if bin[i] != want[i] {
+			t.Errorf("word %d = #%s, want #%s", i, hex(int(bin[i]), 4), hex(int(want[i]), 4))
+		}
+	}
+}
+
+func TestInvalidRegister(t *testing.T) {
+	cases := []struct {
+		line string
+		want string
+	}{
+		{"\tLD\tGR8, DATA", "Line 2: Invalid register \"GR8\""},
+		{"\tLD\tGR1, DATA, GRX", "Line 2: Invalid register \"GRX\""},
+		{"\tLD\tDATA, DATA", "Line 2: Invalid register \"DATA\""},
+		{"\tPOP\tGR9", "Line 2: Invalid register \"GR9\""},
+	}
+	for _, c := range cases {
+		_, _, _, err := assembleSource(t, "MAIN\tSTART\n"+c.line+"\n\tRET\nDATA\tDC\t1\n\tEND\n")
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: error = %v, want %q", c.line, err, c.want)
+		}
+	}
+}
+
+func TestOperandForms(t *testing.T) {
+	cases := []struct {
+		line string
+		want string
+	}{
+		{"\tSLA\tGR1, GR2", "Line 2: Shift count of SLA must be an address, not register \"GR2\""},
+		{"\tLAD\tGR1, GR2", "Line 2: LAD takes an address, not register \"GR2\""},
+		{"\tJUMP\tGR1", "Line 2: JUMP takes an address, not register \"GR1\""},
+		{"\tLD\tGR1, DATA, GR0", "Line 2: Can't use GR0 as an index register"},
+	}
+	for _, c := range cases {
+		_, _, _, err := assembleSource(t, "MAIN\tSTART\n"+c.line+"\n\tRET\nDATA\tDC\t1\n\tEND\n")
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: error = %v, want %q", c.line, err, c.want)
+		}
+	}
+
+	// A shift count may still be indexed
+	if _, _, _, err := assembleSource(t, "MAIN\tSTART\n\tSLA\tGR1, 2, GR3\n\tRET\n\tEND\n"); err != nil {
+		t.Errorf("assemble failed: %v", err)
+	}
+}
+
+func TestLineEndings(t *testing.T) {
+	lf := "MAIN\tSTART\n\tLD\tGR1, DATA\n\tRET\nDATA\tDC\t5\n\tEND\n"
+	want, _, wantState, err := assembleSource(t, lf)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+
+	variants := map[string]string{
+		"CR":       strings.ReplaceAll(lf, "\n", "\r"),
+		"CRLF":     strings.ReplaceAll(lf, "\n", "\r\n"),
+		"BOM":      "\ufeff" + lf,
+		"BOM+CRLF": "\ufeff" + strings.ReplaceAll(lf, "\n", "\r\n"),
+	}
+	for name, src := range variants {
+		bin, _, asmState, err := assembleSource(t, src)
+		if err != nil {
+			t.Errorf("%s: assemble failed: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(bin, want) {
+			t.Errorf("%s: bin = %v, want %v", name, bin, want)
+		}
+		if got := asmState.symtbl["MAIN:DATA"].Line; got != wantState.symtbl["MAIN:DATA"].Line {
+			t.Errorf("%s: DATA defined at line %d, want 4", name, got)
+		}
+	}
+}
+
+func TestFullWidthSpace(t *testing.T) {
+	want, _, _, err := assembleSource(t, "MAIN\tSTART\n\tLD\tGR1, DATA\n\tRET\nDATA\tDC\t'a　b'\n\tEND\n")
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	// Full-width spaces between fields, but kept inside the string
+	bin, _, _, err := assembleSource(t, "MAIN　START\n　LD　GR1,　DATA\n　RET\nDATA　DC　'a　b'\n　END\n")
+	if err != nil {
+		t.Fatalf("assemble with full-width spaces failed: %v", err)
+	}
+	if len(bin) != len(want) {
+		t.Fatalf("bin = %v, want %v", bin, want)
+	}
+	for i := range want {
+		if bin[i] != want[i] {
+			t.Errorf("word %d = #%s, want #%s", i, hex(int(bin[i]), 4), hex(int(want[i]), 4))
+		}
+	}
+}
+
+func TestBinaryConstants(t *testing.T) {
+	src := `MAIN	START
+	LAD	GR0, #FFFF
+	AND	GR0, =%0000000011111111
+	LAD	GR1, %101
+	RET
+B	DC	%1111000011110000
+	END
+`
+	bin, _, asmState, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	b := expandLabel(asmState.symtbl, "MAIN:B")
+	if bin[b] != 0xf0f0 {
+		t.Errorf("B = #%s, want #f0f0", hex(int(bin[b]), 4))
+	}
+	if bin[5] != 5 {
+		t.Errorf("LAD operand = %d, want 5", bin[5])
+	}
+
+	m := NewMachine(bin, 0)
+	if err := m.Run(0); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if gr0, _ := m.GR(0); gr0 != 0x00ff {
+		t.Errorf("GR0 = #%s, want #00ff", hex(int(gr0), 4))
+	}
+
+	_, _, _, err = assembleSource(t, "MAIN\tSTART\n\tRET\n\tDC\t%11110000111100001\n\tEND\n")
+	if err == nil || !strings.Contains(err.Error(), "\"%11110000111100001\" is out of range") {
+		t.Errorf("Expected range error, got %v", err)
+	}
+
+	_, _, asmState, err = assembleSource(t, "MAIN\tSTART\n\tRET\nBUF\tDS\t%1010\nTAIL\tDC\t1\n\tEND\n")
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	if got := expandLabel(asmState.symtbl, "MAIN:TAIL"); got != 11 {
+		t.Errorf("TAIL = #%s, want #000b", hex(got, 4))
+	}
+
+	_, _, _, err = assembleSource(t, "MAIN\tSTART\n\tRET\n\tDS\t%11110000111100001\n\tEND\n")
+	if err == nil || !strings.Contains(err.Error(), "\"%11110000111100001\" is out of range") {
+		t.Errorf("Expected range error, got %v", err)
+	}
+}
+
+func TestStartEntry(t *testing.T) {
+	src := `SUB	START	ENTRY
+DATA	DC	7
+ENTRY	LD	GR1, DATA
+	RET
+	END
+`
+	bin, start, asmState, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	if start != 1 {
+		t.Errorf("start = #%s, want #0001", hex(int(start), 4))
+	}
+	// The module label still names the first word
+	if got := expandLabel(asmState.symtbl, "SUB:SUB"); got != 0 {
+		t.Errorf("SUB = #%s, want #0000", hex(got, 4))
+	}
+
+	m := NewMachine(bin, start)
+	if err := m.Run(0); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if gr1, _ := m.GR(1); gr1 != 7 {
+		t.Errorf("GR1 = %d, want 7", gr1)
+	}
+
+	_, _, _, err = assembleSource(t, "MAIN\tSTART\tNOPE\n\tRET\n\tEND\n")
+	if err == nil || !strings.Contains(err.Error(), "Line 1: Undefined label \"NOPE\"") {
+		t.Errorf("Expected undefined label error, got %v", err)
+	}
+}
+
+func TestMnemonicLabel(t *testing.T) {
+	src := `MAIN	START
+LD	LD	GR1, LD
+	RET
+	END
+`
+	bin, _, _, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	// The label LD names the LD instruction itself
+	if len(bin) < 2 || bin[0] != 0x1010 || bin[1] != 0 {
+		t.Errorf("bin = %04x, want LD GR1, #0000 first", bin)
+	}
+}
+
+func TestMultipleErrors(t *testing.T) {
+	src := `MAIN	START
+	LD	GR1
+	PUSH
+	LEA	GR1, 0
+	POP	GR1, GR2
+AFTER	RET
+	END
+`
+	_, _, asmState, err := assembleSource(t, src)
+	if err == nil {
+		t.Fatal("Expected errors")
+	}
+	for _, want := range []string{
+		"Line 2: Invalid operand \"GR1\"",
+		"Line 3: Invalid operand \"\"",
+		"Line 4: Illegal instruction \"LEA\"",
+		"Line 5: Invalid operand \"GR1, GR2\"",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q missing from:\n%s", want, err)
+		}
+	}
+
+	// Coloring is left to the front end
+	if strings.Contains(err.Error(), "\x1b[") {
+		t.Errorf("Error contains color codes: %q", err)
+	}
+
+	// Skipped instructions keep their size, except the unknown one
+	if got := expandLabel(asmState.symtbl, "MAIN:AFTER"); got != 5 {
+		t.Errorf("AFTER = #%s, want #0005", hex(got, 4))
+	}
+}
+
+func TestMultipleDirectiveErrors(t *testing.T) {
+	src := `MAIN	START
+	DC	99999
+	DS	X
+	EQU	1
+	ORG	-1
+	LD	GR1
+AFTER	RET
+	END	BEGIN
+`
+	_, _, asmState, err := assembleSource(t, src)
+	if err == nil {
+		t.Fatal("Expected errors")
+	}
+	for _, want := range []string{
+		"Line 2: \"99999\" is out of range",
+		"Line 3: \"X\" must be decimal",
+		"Line 4: No label found at EQU",
+		"Line 5: \"-1\" is out of range",
+		"Line 6: Invalid operand \"GR1\"",
+		"Line 8: Invalid operand \"BEGIN\"",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q missing from:\n%s", want, err)
+		}
+	}
+
+	// The bad DC keeps its word; the bad DS, EQU and ORG take none
+	if got := expandLabel(asmState.symtbl, "MAIN:AFTER"); got != 3 {
+		t.Errorf("AFTER = #%s, want #0003", hex(got, 4))
+	}
+}
+
+func TestFirstError(t *testing.T) {
+	src := "MAIN\tSTART\n\tLD\tGR1\n\tPUSH\n\tRET\n\tEND\n"
+	asmState := NewAssemblerState()
+	asmState.KeepGoing = false
+	_, _, err := assembleText(src, "test.cas", asmState)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if !strings.Contains(err.Error(), "Line 2:") || strings.Contains(err.Error(), "Line 3:") {
+		t.Errorf("Expected only the line 2 error, got:\n%s", err)
+	}
+}
+
+func TestSiblingScopeLabel(t *testing.T) {
+	// DATA exists only in SUB, so MAIN's reference must not resolve to 0
+	src := `MAIN	START
+	LD	GR1, DATA
+	JUMP	DATA+1
+	RET
+	END
+SUB	START
+DATA	DC	1
+	RET
+	END
+`
+	_, _, _, err := assembleSource(t, src)
+	for _, want := range []string{"Line 2: Undefined label \"DATA\"", "Line 3: Undefined label \"DATA\""} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q, got %v", want, err)
+		}
+	}
+}
+
+func TestLenientComments(t *testing.T) {
+	src := `MAIN	START
+	LD	GR0, =1   this is a comment
+	LD	GR1, =' x', GR2 quoted spaces stay
+	DC	'a b', 3 two values
+	RET	done
+	END
+`
+	if _, _, _, err := assembleSource(t, src); err == nil {
+		t.Errorf("Expected errors without -lenient")
+	}
+
+	asmState := NewAssemblerState()
+	asmState.Lenient = true
+	bin, _, err := assembleText(src, "test.cas", asmState)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	// LD, LD, 'a b' + NUL, 3, RET, then the literals =1 and =' x'
+	want := []uint16{0x1000, 0x000a, 0x1012, 0x000b, 'a', ' ', 'b', 0, 3, 0x8100, 1, ' ', 'x', 0}
+	if !reflect.DeepEqual(bin, want) {
+		t.Errorf("bin = %04x, want %04x", bin, want)
+	}
+}
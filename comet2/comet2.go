@@ -0,0 +1,287 @@
+package comet2
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// System call addresses
+const (
+	SYS_IN   = 0xfff0
+	SYS_OUT  = 0xfff2
+	EXIT_USR = 0x0000
+	EXIT_OVF = 0x0001
+	EXIT_DVZ = 0x0002
+	EXIT_ROV = 0x0003
+
+	// A program ending with SVC N exits the process with SVC_EXIT_STATUS+N
+	SVC_EXIT_STATUS = 10
+	// A program stopped by a stack overflow or underflow exits with this
+	STACK_EXIT_STATUS = 20
+)
+
+// Flag register bits
+const (
+	FR_PLUS  = 0
+	FR_ZERO  = 1
+	FR_MINUS = 2
+	FR_OVER  = 4
+)
+
+// Stack configuration
+const STACK_TOP = 0xff00
+
+// Memory configuration
+const MEMORY_SIZE = 0x10000
+
+// Register indices
+const (
+	PC = iota
+	FR
+	GR0
+	GR1
+	GR2
+	GR3
+	GR4
+	GR5
+	GR6
+	GR7
+	SP
+)
+
+// Value limits
+const (
+	MAX_SIGNED = 32767
+	MIN_SIGNED = -32768
+)
+
+// Instruction table for CASL2
+type instructionType string
+
+const (
+	op1     instructionType = "op1"
+	op2     instructionType = "op2"
+	op3     instructionType = "op3"
+	op4     instructionType = "op4"
+	op5     instructionType = "op5"
+	opStart instructionType = "start"
+	opEnd   instructionType = "end"
+	opDS    instructionType = "ds"
+	opDC    instructionType = "dc"
+	opIN    instructionType = "in"
+	opOUT   instructionType = "out"
+	opRPUSH instructionType = "rpush"
+	opRPOP  instructionType = "rpop"
+	opEQU   instructionType = "equ"
+	opORG   instructionType = "org"
+)
+
+type casl2Instruction struct {
+	Code uint8
+	Type instructionType
+}
+
+var casl2tbl = map[string]casl2Instruction{
+	"NOP":   {0x00, op4},
+	"LD":    {0x10, op5},
+	"ST":    {0x11, op1},
+	"LAD":   {0x12, op1},
+	"ADDA":  {0x20, op5},
+	"SUBA":  {0x21, op5},
+	"ADDL":  {0x22, op5},
+	"SUBL":  {0x23, op5},
+	"MULA":  {0x28, op5},
+	"DIVA":  {0x29, op5},
+	"MULL":  {0x2A, op5},
+	"DIVL":  {0x2B, op5},
+	"AND":   {0x30, op5},
+	"OR":    {0x31, op5},
+	"XOR":   {0x32, op5},
+	"CPA":   {0x40, op5},
+	"CPL":   {0x41, op5},
+	"SLA":   {0x50, op1},
+	"SRA":   {0x51, op1},
+	"SLL":   {0x52, op1},
+	"SRL":   {0x53, op1},
+	"JMI":   {0x61, op2},
+	"JNZ":   {0x62, op2},
+	"JZE":   {0x63, op2},
+	"JUMP":  {0x64, op2},
+	"JPL":   {0x65, op2},
+	"JOV":   {0x66, op2},
+	"PUSH":  {0x70, op2},
+	"POP":   {0x71, op3},
+	"CALL":  {0x80, op2},
+	"RET":   {0x81, op4},
+	"SVC":   {0xf0, op2},
+	"START": {0x00, opStart},
+	"END":   {0x00, opEnd},
+	"DS":    {0x00, opDS},
+	"DC":    {0x00, opDC},
+	"IN":    {0x00, opIN},
+	"OUT":   {0x00, opOUT},
+	"RPUSH": {0x00, opRPUSH},
+	"RPOP":  {0x00, opRPOP},
+	"EQU":   {0x00, opEQU},
+	"ORG":   {0x00, opORG},
+}
+
+// Symbol table entry
+type symbolEntry struct {
+	Val  interface{}
+	File string
+	Line int
+}
+
+type memoryEntry struct {
+	Val  interface{}
+	File string
+	Line int
+	// Code marks the first word of an instruction
+	Code bool
+	// Reserved marks a word reserved by DS without a fill value
+	Reserved bool
+	// Operand marks the address word of a two-word instruction
+	Operand bool
+}
+
+// Position of a line in the source files
+type sourcePos struct {
+	File string
+	Line int
+}
+
+// Assembler state
+type AssemblerState struct {
+	symtbl         map[string]*symbolEntry
+	memory         map[int]*memoryEntry
+	buf            map[sourcePos]string
+	order          []sourcePos
+	outdump        []string
+	actualLabel    string
+	virtualLabel   string
+	firstStart     bool
+	varScope       string
+	literalCounter int
+	refs           map[string]bool
+	file           string
+	mainFile       string
+	line           int
+	// Further source files assembled after the main one (-link)
+	LinkFiles []string
+	// KeepGoing records the errors of bad lines, returned by Errors, and
+	// assembles on, so that every error is found in one run
+	KeepGoing bool
+	errs      []error
+	// Column that errors on the current line point at (0 if unknown), and
+	// where the operands of each line start
+	column   int
+	operands map[sourcePos]operandField
+	// End of the program after pass1, which the stack must not reach
+	addressMax int
+	// Lenient reads text after the operands as a comment (-lenient)
+	Lenient bool
+	// Listing collects the listing returned by ListingLines (-a)
+	Listing bool
+}
+
+// Operand field of a source line
+type operandField struct {
+	Column int
+	Text   string
+}
+
+func NewAssemblerState() *AssemblerState {
+	return &AssemblerState{
+		symtbl:     make(map[string]*symbolEntry),
+		refs:       make(map[string]bool),
+		memory:     make(map[int]*memoryEntry),
+		buf:        make(map[sourcePos]string),
+		operands:   make(map[sourcePos]operandField),
+		outdump:    make([]string, 0),
+		firstStart: true,
+		KeepGoing:  true,
+	}
+}
+
+// Utility functions
+func hex(val int, length int) string {
+	format := fmt.Sprintf("%%0%dx", length)
+	return fmt.Sprintf(format, val)
+}
+
+func signed(val int) int {
+	if val >= 32768 && val < 65536 {
+		val -= 65536
+	}
+	return val
+}
+
+func unsigned(val int) int {
+	if val >= -32768 && val < 0 {
+		val += 65536
+	}
+	return val
+}
+
+func checkNumber(val string) bool {
+	if val == "" {
+		return false
+	}
+	if strings.HasPrefix(val, "#") {
+		_, err := strconv.ParseInt(val[1:], 16, 64)
+		return err == nil
+	}
+	if strings.HasPrefix(val, "%") {
+		_, err := strconv.ParseInt(val[1:], 2, 64)
+		return err == nil
+	}
+	_, err := strconv.ParseInt(val, 10, 64)
+	return err == nil
+}
+
+func ExpandNumber(val string) (int, bool) {
+	if !checkNumber(val) {
+		return 0, false
+	}
+	if strings.HasPrefix(val, "#") {
+		num, err := strconv.ParseInt(val[1:], 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		// Safe: masked to 16 bits
+		return int(num & 0xffff), true
+	}
+	if strings.HasPrefix(val, "%") {
+		num, err := strconv.ParseInt(val[1:], 2, 64)
+		if err != nil {
+			return 0, false
+		}
+		// Safe: masked to 16 bits
+		return int(num & 0xffff), true
+	}
+	num, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	// Safe: masked to 16 bits
+	return int(num & 0xffff), true
+}
+
+func getFlag(val int) int {
+	if val&0x8000 != 0 {
+		return FR_MINUS
+	} else if val == 0 {
+		return FR_ZERO
+	} else {
+		return FR_PLUS
+	}
+}
+
+func memGet(memory []uint16, pc int) int {
+	if pc < 0 || pc >= MEMORY_SIZE {
+		return 0
+	}
+	return int(memory[pc])
+}
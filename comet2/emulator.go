@@ -0,0 +1,843 @@
+package comet2
+
+import (
+	"fmt"
+	"strings"
+)
+
+// COMET2 instruction table
+type comet2Instruction struct {
+	ID   string
+	Type instructionType
+}
+
+var comet2tbl = map[int]comet2Instruction{
+	0x00: {"NOP", op4},
+	0x10: {"LD", op1},
+	0x11: {"ST", op1},
+	0x12: {"LAD", op1},
+	0x14: {"LD", op5},
+	0x20: {"ADDA", op1},
+	0x21: {"SUBA", op1},
+	0x22: {"ADDL", op1},
+	0x23: {"SUBL", op1},
+	0x24: {"ADDA", op5},
+	0x25: {"SUBA", op5},
+	0x26: {"ADDL", op5},
+	0x27: {"SUBL", op5},
+	0x28: {"MULA", op1},
+	0x29: {"DIVA", op1},
+	0x2a: {"MULL", op1},
+	0x2b: {"DIVL", op1},
+	0x2c: {"MULA", op5},
+	0x2d: {"DIVA", op5},
+	0x2e: {"MULL", op5},
+	0x2f: {"DIVL", op5},
+	0x30: {"AND", op1},
+	0x31: {"OR", op1},
+	0x32: {"XOR", op1},
+	0x34: {"AND", op5},
+	0x35: {"OR", op5},
+	0x36: {"XOR", op5},
+	0x40: {"CPA", op1},
+	0x41: {"CPL", op1},
+	0x44: {"CPA", op5},
+	0x45: {"CPL", op5},
+	0x50: {"SLA", op1},
+	0x51: {"SRA", op1},
+	0x52: {"SLL", op1},
+	0x53: {"SRL", op1},
+	0x61: {"JMI", op2},
+	0x62: {"JNZ", op2},
+	0x63: {"JZE", op2},
+	0x64: {"JUMP", op2},
+	0x65: {"JPL", op2},
+	0x66: {"JOV", op2},
+	0x70: {"PUSH", op2},
+	0x71: {"POP", op3},
+	0x80: {"CALL", op2},
+	0x81: {"RET", op4},
+	0xf0: {"SVC", op2},
+}
+
+// Extra cycles spent by slow instructions; every other instruction costs
+// one cycle per word
+var comet2cost = map[string]int{
+	"MULA": 4,
+	"MULL": 4,
+	"DIVA": 8,
+	"DIVL": 8,
+	"CALL": 1,
+	"RET":  1,
+	"SVC":  4,
+}
+
+// Disassemble decodes the instruction at state[PC] into its mnemonic, its
+// operands and its size in words
+func Disassemble(memory []uint16, state []int) (string, string, int) {
+	pc := state[PC]
+	inst := memGet(memory, pc) >> 8
+	gr := (memGet(memory, pc) >> 4) & 0xf
+	xr := memGet(memory, pc) & 0xf
+	adr := memGet(memory, pc+1)
+
+	instSym := "DC"
+	oprSym := fmt.Sprintf("#%s", hex(memGet(memory, pc), 4))
+	size := 1
+
+	if comet2Inst, ok := comet2tbl[inst]; ok {
+		instSym = comet2Inst.ID
+		instType := comet2Inst.Type
+
+		switch instType {
+		case op1:
+			oprSym = fmt.Sprintf("GR%d,   #%s", gr, hex(adr, 4))
+			if xr > 0 {
+				oprSym += fmt.Sprintf(", GR%d", xr)
+			}
+			size = 2
+		case op2:
+			oprSym = fmt.Sprintf("#%s", hex(adr, 4))
+			if xr > 0 {
+				oprSym += fmt.Sprintf(", GR%d", xr)
+			}
+			size = 2
+		case op3:
+			oprSym = fmt.Sprintf("GR%d", gr)
+			size = 1
+		case op4:
+			oprSym = ""
+			size = 1
+		case op5:
+			oprSym = fmt.Sprintf("GR%d, GR%d", gr, xr)
+			size = 1
+		}
+	}
+
+	return instSym, oprSym, size
+}
+
+// InputFunc supplies the line read by IN
+type InputFunc func() string
+
+// OutputFunc receives the text written by OUT
+type OutputFunc func(string)
+
+// Input completes SVC #FFF0 (IN) with line: it stores one byte of the line
+// per word from the address in GR1 and the number of bytes at the address
+// in GR2. The IN macro sets GR1 and GR2 the same way, so a direct SVC
+// behaves alike.
+func (m *Machine) Input(line string) {
+	text := strings.TrimSpace(line)
+	if len(text) > m.InputLimit {
+		text = text[:m.InputLimit]
+	}
+
+	lenp := m.state[GR2]
+	bufp := m.state[GR1]
+
+	// Bytes rather than runes, so that OUT writes back the same text
+	m.put(lenp, len(text))
+	for i := 0; i < len(text); i++ {
+		m.put(bufp+i, int(text[i]))
+	}
+
+	m.state[PC] += 2
+}
+
+// output performs SVC #FFF2 (OUT): it writes the low byte of each word from
+// the address in GR1, for the count stored at the address in GR2
+func (m *Machine) output() {
+	lenp := m.state[GR2]
+	bufp := m.state[GR1]
+	length := memGet(m.memory, lenp)
+
+	var outstr strings.Builder
+	for i := 0; i < length; i++ {
+		outstr.WriteByte(byte(memGet(m.memory, bufp+i) & 0xff))
+	}
+
+	if m.Out != nil {
+		m.Out(outstr.String())
+	}
+}
+
+// SVCExit is returned by Execute when the program ends with SVC 0-3
+type SVCExit struct {
+	Code int
+}
+
+func (e *SVCExit) Error() string {
+	return fmt.Sprintf("Program finished (SVC %d)", e.Code)
+}
+
+// Fault is a runtime error that ends the program abnormally; the
+// process exits with Status
+type Fault struct {
+	Msg    string
+	Status int
+}
+
+func (e *Fault) Error() string {
+	return e.Msg
+}
+
+// stackFault is the fault raised when SP leaves the stack area
+func stackFault(what string, pc, sp int) error {
+	return &Fault{fmt.Sprintf("Stack %s at #%s: SP = #%s", what, hex(pc, 4), hex(sp, 4)), STACK_EXIT_STATUS}
+}
+
+// divisionByZero is the fault raised by DIVA and DIVL; with DivContinue it
+// is only a warning, for the legacy flags-only behavior
+func divisionByZero(inst string, pc int) error {
+	return &Fault{fmt.Sprintf("Division by zero in %s at #%s", inst, hex(pc, 4)), SVC_EXIT_STATUS + EXIT_DVZ}
+}
+
+// read returns the operand word at addr, warning the first time a word in
+// Uninitialized is read before anything was stored there
+func (m *Machine) read(addr int) int {
+	if m.Uninitialized[addr] {
+		delete(m.Uninitialized, addr)
+		m.warn(fmt.Sprintf("Read of uninitialized memory at #%s", hex(addr, 4)))
+	}
+	return memGet(m.memory, addr)
+}
+
+// put stores val at addr, clearing its Uninitialized mark and passing the
+// old value to OnWrite; addresses outside memory are ignored
+func (m *Machine) put(addr int, val int) {
+	if addr < 0 || addr >= MEMORY_SIZE {
+		return
+	}
+	delete(m.Uninitialized, addr)
+	if m.OnWrite != nil {
+		m.OnWrite(addr, m.memory[addr])
+	}
+	m.memory[addr] = uint16(val & 0xffff)
+}
+
+func (m *Machine) warn(msg string) {
+	if m.Warn != nil {
+		m.Warn(msg)
+	}
+}
+
+// checkStackMargin warns once when PUSH or CALL at pc brings SP within
+// StackWarn words of the program, before the stack overflows into it
+func (m *Machine) checkStackMargin(pc, sp int) {
+	if m.StackWarn <= 0 || m.stackWarned || sp-m.AddressMax > m.StackWarn {
+		return
+	}
+	m.stackWarned = true
+	m.warn(fmt.Sprintf("Stack is within %d words of the program at #%s: SP = #%s", sp-m.AddressMax, hex(pc, 4), hex(sp, 4)))
+}
+
+// ValidEncoding reports whether word is an instruction the assembler could
+// have produced: a known opcode with register fields its form allows
+func ValidEncoding(word int) bool {
+	comet2Inst, ok := comet2tbl[word>>8]
+	if !ok {
+		return false
+	}
+	gr := (word >> 4) & 0xf
+	xr := word & 0xf
+	switch comet2Inst.Type {
+	case op1, op5:
+		return gr <= 7 && xr <= 7
+	case op2:
+		return gr == 0 && xr <= 7
+	case op3:
+		return gr <= 7 && xr == 0
+	default:
+		return gr == 0 && xr == 0
+	}
+}
+
+// SetsFlags reports whether the instruction word sets FR from its result:
+// LD and the arithmetic, logical, compare and shift instructions
+func SetsFlags(word int) bool {
+	op := word >> 8
+	return op == 0x10 || op >= 0x14 && op <= 0x53
+}
+
+// Execute executes one instruction, writing OUT through Out. It returns
+// true at SVC IN without moving PC; the caller then passes the line to
+// Input.
+func (m *Machine) Execute() (bool, error) {
+	pc := m.state[PC]
+	fr := m.state[FR]
+	sp := m.state[SP]
+	regs := m.state[GR0 : GR7+1]
+
+	instVal := memGet(m.memory, pc)
+	gr := (instVal >> 4) & 0xf
+	xr := instVal & 0xf
+	adr := memGet(m.memory, pc+1)
+	eadr := adr
+
+	var val int
+	stopFlag := false
+
+	if xr >= 1 && xr <= 7 {
+		eadr += regs[xr]
+	}
+	eadr &= 0xffff
+
+	// Strict mode refuses data words instead of running them as the
+	// nearest instruction
+	if m.Strict && !ValidEncoding(instVal) {
+		return false, fmt.Errorf("Illegal instruction word #%s at #%s", hex(instVal, 4), hex(pc, 4))
+	}
+
+	// Decode the opcode directly; OP5 entries are the GR,GR forms
+	inst := "DC"
+	grIsGrForm := false
+	if comet2Inst, ok := comet2tbl[instVal>>8]; ok {
+		inst = comet2Inst.ID
+		grIsGrForm = comet2Inst.Type == op5 && gr <= 7 && xr <= 7
+
+		m.Instructions++
+		m.Cycles += comet2cost[inst] + 1
+		if comet2Inst.Type == op1 || comet2Inst.Type == op2 {
+			m.Cycles++
+		}
+	}
+
+	switch inst {
+	case "LD":
+		if !grIsGrForm {
+			regs[gr] = m.read(eadr)
+			fr = getFlag(regs[gr])
+			pc += 2
+		} else {
+			regs[gr] = regs[xr]
+			fr = getFlag(regs[gr])
+			pc++
+		}
+
+	case "ST":
+		m.put(eadr, regs[gr])
+		pc += 2
+
+	case "LAD":
+		regs[gr] = eadr
+		pc += 2
+
+	case "ADDA":
+		if !grIsGrForm {
+			regs[gr] = signed(regs[gr])
+			regs[gr] += m.read(eadr)
+			ofr1 := 0
+			ofr2 := 0
+			if regs[gr] > MAX_SIGNED {
+				ofr1 = FR_OVER
+			}
+			if regs[gr] < MIN_SIGNED {
+				ofr2 = FR_OVER
+			}
+			regs[gr] &= 0xffff
+			fr = getFlag(regs[gr]) | ofr1 | ofr2
+			pc += 2
+		} else {
+			regs[gr] = signed(regs[gr])
+			regs[xr] = signed(regs[xr])
+			regs[gr] += regs[xr]
+			ofr1 := 0
+			ofr2 := 0
+			if regs[gr] > MAX_SIGNED {
+				ofr1 = FR_OVER
+			}
+			if regs[gr] < MIN_SIGNED {
+				ofr2 = FR_OVER
+			}
+			regs[gr] &= 0xffff
+			regs[xr] &= 0xffff
+			fr = getFlag(regs[gr]) | ofr1 | ofr2
+			pc++
+		}
+
+	case "SUBA":
+		if !grIsGrForm {
+			regs[gr] = signed(regs[gr])
+			regs[gr] -= m.read(eadr)
+			ofr1 := 0
+			ofr2 := 0
+			if regs[gr] > MAX_SIGNED {
+				ofr1 = FR_OVER
+			}
+			if regs[gr] < MIN_SIGNED {
+				ofr2 = FR_OVER
+			}
+			regs[gr] &= 0xffff
+			fr = getFlag(regs[gr]) | ofr1 | ofr2
+			pc += 2
+		} else {
+			regs[gr] = signed(regs[gr])
+			regs[xr] = signed(regs[xr])
+			regs[gr] -= regs[xr]
+			ofr1 := 0
+			ofr2 := 0
+			if regs[gr] > MAX_SIGNED {
+				ofr1 = FR_OVER
+			}
+			if regs[gr] < MIN_SIGNED {
+				ofr2 = FR_OVER
+			}
+			regs[gr] &= 0xffff
+			regs[xr] &= 0xffff
+			fr = getFlag(regs[gr]) | ofr1 | ofr2
+			pc++
+		}
+
+	case "ADDL":
+		if !grIsGrForm {
+			regs[gr] += m.read(eadr)
+			ofr1 := 0
+			ofr2 := 0
+			if regs[gr] > 0xffff {
+				ofr1 = FR_OVER
+			}
+			if regs[gr] < 0 {
+				ofr2 = FR_OVER
+			}
+			regs[gr] &= 0xffff
+			fr = getFlag(regs[gr]) | ofr1 | ofr2
+			pc += 2
+		} else {
+			regs[gr] += regs[xr]
+			ofr1 := 0
+			ofr2 := 0
+			if regs[gr] > 0xffff {
+				ofr1 = FR_OVER
+			}
+			if regs[gr] < 0 {
+				ofr2 = FR_OVER
+			}
+			regs[gr] &= 0xffff
+			fr = getFlag(regs[gr]) | ofr1 | ofr2
+			pc++
+		}
+
+	case "SUBL":
+		if !grIsGrForm {
+			regs[gr] -= m.read(eadr)
+			ofr1 := 0
+			ofr2 := 0
+			if regs[gr] > 0xffff {
+				ofr1 = FR_OVER
+			}
+			if regs[gr] < 0 {
+				ofr2 = FR_OVER
+			}
+			regs[gr] &= 0xffff
+			fr = getFlag(regs[gr]) | ofr1 | ofr2
+			pc += 2
+		} else {
+			regs[gr] -= regs[xr]
+			ofr1 := 0
+			ofr2 := 0
+			if regs[gr] > 0xffff {
+				ofr1 = FR_OVER
+			}
+			if regs[gr] < 0 {
+				ofr2 = FR_OVER
+			}
+			regs[gr] &= 0xffff
+			fr = getFlag(regs[gr]) | ofr1 | ofr2
+			pc++
+		}
+
+	case "MULA":
+		if !grIsGrForm {
+			regs[gr] = signed(regs[gr])
+			regs[gr] *= m.read(eadr)
+			ofr1 := 0
+			ofr2 := 0
+			if regs[gr] > MAX_SIGNED {
+				ofr1 = FR_OVER
+			}
+			if regs[gr] < MIN_SIGNED {
+				ofr2 = FR_OVER
+			}
+			regs[gr] &= 0xffff
+			fr = getFlag(regs[gr]) | ofr1 | ofr2
+			pc += 2
+		} else {
+			regs[gr] = signed(regs[gr])
+			regs[xr] = signed(regs[xr])
+			regs[gr] *= regs[xr]
+			ofr1 := 0
+			ofr2 := 0
+			if regs[gr] > MAX_SIGNED {
+				ofr1 = FR_OVER
+			}
+			if regs[gr] < MIN_SIGNED {
+				ofr2 = FR_OVER
+			}
+			regs[gr] &= 0xffff
+			regs[xr] &= 0xffff
+			fr = getFlag(regs[gr]) | ofr1 | ofr2
+			pc++
+		}
+
+	case "MULL":
+		if !grIsGrForm {
+			regs[gr] *= m.read(eadr)
+			ofr1 := 0
+			ofr2 := 0
+			if regs[gr] > 0xffff {
+				ofr1 = FR_OVER
+			}
+			if regs[gr] < 0 {
+				ofr2 = FR_OVER
+			}
+			regs[gr] &= 0xffff
+			fr = getFlag(regs[gr]) | ofr1 | ofr2
+			pc += 2
+		} else {
+			regs[gr] *= regs[xr]
+			ofr1 := 0
+			ofr2 := 0
+			if regs[gr] > 0xffff {
+				ofr1 = FR_OVER
+			}
+			if regs[gr] < 0 {
+				ofr2 = FR_OVER
+			}
+			regs[gr] &= 0xffff
+			regs[xr] &= 0xffff
+			fr = getFlag(regs[gr]) | ofr1 | ofr2
+			pc++
+		}
+
+	case "DIVA":
+		if !grIsGrForm {
+			d := m.read(eadr)
+			if d == 0 {
+				if !m.DivContinue {
+					return false, divisionByZero("DIVA", pc)
+				}
+				fr = FR_OVER | FR_ZERO
+				m.warn(divisionByZero("DIVA", pc).Error())
+				pc += 2
+			} else {
+				regs[gr] = signed(regs[gr])
+				regs[gr] /= d
+				ofr1 := 0
+				ofr2 := 0
+				if regs[gr] > MAX_SIGNED {
+					ofr1 = FR_OVER
+				}
+				if regs[gr] < MIN_SIGNED {
+					ofr2 = FR_OVER
+				}
+				regs[gr] &= 0xffff
+				fr = getFlag(regs[gr]) | ofr1 | ofr2
+				pc += 2
+			}
+		} else {
+			if regs[xr] == 0 {
+				if !m.DivContinue {
+					return false, divisionByZero("DIVA", pc)
+				}
+				fr = FR_OVER | FR_ZERO
+				m.warn(divisionByZero("DIVA", pc).Error())
+				pc++
+			} else {
+				regs[gr] = signed(regs[gr])
+				regs[xr] = signed(regs[xr])
+				regs[gr] /= regs[xr]
+				ofr1 := 0
+				ofr2 := 0
+				if regs[gr] > MAX_SIGNED {
+					ofr1 = FR_OVER
+				}
+				if regs[gr] < MIN_SIGNED {
+					ofr2 = FR_OVER
+				}
+				regs[gr] &= 0xffff
+				regs[xr] &= 0xffff
+				fr = getFlag(regs[gr]) | ofr1 | ofr2
+				pc++
+			}
+		}
+
+	case "DIVL":
+		if !grIsGrForm {
+			d := m.read(eadr)
+			if d == 0 {
+				if !m.DivContinue {
+					return false, divisionByZero("DIVL", pc)
+				}
+				fr = FR_OVER | FR_ZERO
+				m.warn(divisionByZero("DIVL", pc).Error())
+				pc += 2
+			} else {
+				regs[gr] /= d
+				ofr1 := 0
+				ofr2 := 0
+				if regs[gr] > 0xffff {
+					ofr1 = FR_OVER
+				}
+				if regs[gr] < 0 {
+					ofr2 = FR_OVER
+				}
+				regs[gr] &= 0xffff
+				fr = getFlag(regs[gr]) | ofr1 | ofr2
+				pc += 2
+			}
+		} else {
+			if regs[xr] == 0 {
+				if !m.DivContinue {
+					return false, divisionByZero("DIVL", pc)
+				}
+				fr = FR_OVER | FR_ZERO
+				m.warn(divisionByZero("DIVL", pc).Error())
+				pc++
+			} else {
+				regs[gr] /= regs[xr]
+				ofr1 := 0
+				ofr2 := 0
+				if regs[gr] > 0xffff {
+					ofr1 = FR_OVER
+				}
+				if regs[gr] < 0 {
+					ofr2 = FR_OVER
+				}
+				regs[gr] &= 0xffff
+				regs[xr] &= 0xffff
+				fr = getFlag(regs[gr]) | ofr1 | ofr2
+				pc++
+			}
+		}
+
+	case "AND":
+		if !grIsGrForm {
+			regs[gr] &= m.read(eadr)
+			fr = getFlag(regs[gr])
+			pc += 2
+		} else {
+			regs[gr] &= regs[xr]
+			fr = getFlag(regs[gr])
+			pc++
+		}
+
+	case "OR":
+		if !grIsGrForm {
+			regs[gr] |= m.read(eadr)
+			fr = getFlag(regs[gr])
+			pc += 2
+		} else {
+			regs[gr] |= regs[xr]
+			fr = getFlag(regs[gr])
+			pc++
+		}
+
+	case "XOR":
+		if !grIsGrForm {
+			regs[gr] ^= m.read(eadr)
+			fr = getFlag(regs[gr])
+			pc += 2
+		} else {
+			regs[gr] ^= regs[xr]
+			fr = getFlag(regs[gr])
+			pc++
+		}
+
+	case "CPA":
+		if !grIsGrForm {
+			val = signed(regs[gr]) - signed(m.read(eadr))
+			if val > MAX_SIGNED {
+				val = MAX_SIGNED
+			}
+			if val < MIN_SIGNED {
+				val = MIN_SIGNED
+			}
+			fr = getFlag(unsigned(val))
+			pc += 2
+		} else {
+			val = signed(regs[gr]) - signed(regs[xr])
+			if val > MAX_SIGNED {
+				val = MAX_SIGNED
+			}
+			if val < MIN_SIGNED {
+				val = MIN_SIGNED
+			}
+			fr = getFlag(unsigned(val))
+			pc++
+		}
+
+	case "CPL":
+		if !grIsGrForm {
+			val = regs[gr] - m.read(eadr)
+			if val > MAX_SIGNED {
+				val = MAX_SIGNED
+			}
+			if val < MIN_SIGNED {
+				val = MIN_SIGNED
+			}
+			fr = getFlag(unsigned(val))
+			pc += 2
+		} else {
+			val = regs[gr] - regs[xr]
+			if val > MAX_SIGNED {
+				val = MAX_SIGNED
+			}
+			if val < MIN_SIGNED {
+				val = MIN_SIGNED
+			}
+			fr = getFlag(unsigned(val))
+			pc++
+		}
+
+	case "SLA":
+		// Only bits 0-14 are shifted; the sign bit is preserved and OF is
+		// the last bit shifted out of bit 14
+		if eadr > 0 {
+			val = regs[gr] & 0x7fff
+			ofr := 0
+			if (val<<(eadr-1))&0x4000 != 0 {
+				ofr = FR_OVER
+			}
+			regs[gr] = (regs[gr] & 0x8000) | ((val << eadr) & 0x7fff)
+			fr = getFlag(regs[gr]) | ofr
+		}
+		pc += 2
+
+	case "SRA":
+		// Shift the signed value so that vacated bits are filled with the
+		// sign bit; OF is the last bit shifted out
+		if eadr > 0 {
+			val = signed(regs[gr])
+			ofr := 0
+			if (val>>(eadr-1))&1 != 0 {
+				ofr = FR_OVER
+			}
+			regs[gr] = (val >> eadr) & 0xffff
+			fr = getFlag(regs[gr]) | ofr
+		}
+		pc += 2
+
+	case "SLL":
+		// OF is the last bit shifted out of bit 15
+		if eadr > 0 {
+			ofr := 0
+			if (regs[gr]<<(eadr-1))&0x8000 != 0 {
+				ofr = FR_OVER
+			}
+			regs[gr] = (regs[gr] << eadr) & 0xffff
+			fr = getFlag(regs[gr]) | ofr
+		}
+		pc += 2
+
+	case "SRL":
+		// OF is the last bit shifted out of bit 0
+		if eadr > 0 {
+			ofr := 0
+			if (regs[gr]>>(eadr-1))&1 != 0 {
+				ofr = FR_OVER
+			}
+			regs[gr] >>= eadr
+			fr = getFlag(regs[gr]) | ofr
+		}
+		pc += 2
+
+	case "JMI":
+		if (fr & FR_MINUS) == FR_MINUS {
+			pc = eadr
+		} else {
+			pc += 2
+		}
+
+	case "JNZ":
+		if (fr & FR_ZERO) != FR_ZERO {
+			pc = eadr
+		} else {
+			pc += 2
+		}
+
+	case "JZE":
+		if (fr & FR_ZERO) == FR_ZERO {
+			pc = eadr
+		} else {
+			pc += 2
+		}
+
+	case "JUMP":
+		pc = eadr
+
+	case "JPL":
+		if ((fr & FR_MINUS) != FR_MINUS) && ((fr & FR_ZERO) != FR_ZERO) {
+			pc = eadr
+		} else {
+			pc += 2
+		}
+
+	case "JOV":
+		if (fr & FR_OVER) != 0 {
+			pc = eadr
+		} else {
+			pc += 2
+		}
+
+	case "PUSH":
+		sp--
+		if sp <= m.AddressMax {
+			return false, stackFault("overflow", pc, sp)
+		}
+		m.checkStackMargin(pc, sp)
+		m.put(sp, eadr)
+		pc += 2
+
+	case "POP":
+		regs[gr] = memGet(m.memory, sp)
+		sp++
+		if sp > m.StackTop {
+			return false, stackFault("underflow", pc, sp)
+		}
+		pc++
+
+	case "CALL":
+		sp--
+		if sp <= m.AddressMax {
+			return false, stackFault("overflow", pc, sp)
+		}
+		m.checkStackMargin(pc, sp)
+		m.put(sp, pc+2)
+		pc = eadr
+
+	case "RET":
+		pc = memGet(m.memory, sp)
+		sp++
+		if sp > m.StackTop {
+			return false, fmt.Errorf("Program finished (RET)")
+		}
+
+	case "SVC":
+		switch eadr {
+		case SYS_IN:
+			stopFlag = true
+		case SYS_OUT:
+			m.output()
+			pc += 2
+		case EXIT_USR, EXIT_OVF, EXIT_DVZ, EXIT_ROV:
+			return false, &SVCExit{eadr}
+		}
+
+	case "NOP":
+		pc++
+
+	default:
+		return false, fmt.Errorf("Illegal instruction %s at #%s", inst, hex(pc, 4))
+	}
+
+	// Update state
+	m.state[PC] = pc
+	m.state[FR] = fr
+	m.state[SP] = sp
+	for i := 0; i < 8; i++ {
+		m.state[GR0+i] = regs[i]
+	}
+
+	return stopFlag, nil
+}
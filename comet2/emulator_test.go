@@ -0,0 +1,364 @@
+package comet2
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMemPutHighAddress(t *testing.T) {
+	m := NewMachine(nil, 0)
+
+	m.put(0xffff, 0x1234)
+	if got := memGet(m.memory, 0xffff); got != 0x1234 {
+		t.Errorf("memGet(#ffff) = #%s, want #1234", hex(got, 4))
+	}
+
+	// Out of range accesses are ignored
+	m.put(MEMORY_SIZE, 0x5678)
+	m.put(-1, 0x5678)
+	if got := memGet(m.memory, MEMORY_SIZE); got != 0 {
+		t.Errorf("memGet(#10000) = #%s, want #0000", hex(got, 4))
+	}
+}
+
+func BenchmarkExecute(b *testing.B) {
+	// LAD GR1,1 / LOOP: ADDA GR0,GR1 / JUMP LOOP
+	m := NewMachine([]uint16{0x1210, 0x0001, 0x2401, 0x6400, 0x0002}, 0)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := m.Execute(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestInstructionCount(t *testing.T) {
+	src := `MAIN	START
+	LAD	GR1, 3
+	LAD	GR2, 1
+LOOP	SUBA	GR1, GR2
+	JNZ	LOOP
+	RET
+	END
+`
+	bin, _, _, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	m := NewMachine(bin, 0)
+	if err := m.Run(0); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	// LAD x2, (SUBA + JNZ) x3, RET
+	if m.Instructions != 9 {
+		t.Errorf("Instructions = %d, want 9", m.Instructions)
+	}
+	// LAD 2+2, SUBA 1x3, JNZ 2x3, RET 1+1
+	if m.Cycles != 15 {
+		t.Errorf("Cycles = %d, want 15", m.Cycles)
+	}
+}
+
+// shiftCase describes one shift instruction execution
+type shiftCase struct {
+	val    int
+	count  int
+	want   int
+	wantFR int
+}
+
+// runShift executes a single shift instruction on GR1 starting from FR = ZF
+func runShift(t *testing.T, code uint16, tc shiftCase) {
+	t.Helper()
+	m := NewMachine([]uint16{code<<8 | 0x10, uint16(tc.count)}, 0)
+	state := m.Registers()
+	state[GR1] = tc.val
+	state[FR] = FR_ZERO
+
+	if _, err := m.Execute(); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if state[GR1] != tc.want || state[FR] != tc.wantFR {
+		t.Errorf("#%s by %d = #%s FR=%d, want #%s FR=%d",
+			hex(tc.val, 4), tc.count, hex(state[GR1], 4), state[FR], hex(tc.want, 4), tc.wantFR)
+	}
+	if state[PC] != 2 {
+		t.Errorf("PC = %d, want 2", state[PC])
+	}
+}
+
+func TestSRA(t *testing.T) {
+	cases := []shiftCase{
+		{0x7ff1, 0, 0x7ff1, FR_ZERO},
+		{0x7ff1, 1, 0x3ff8, FR_OVER},
+		{0x7ff1, 4, 0x07ff, FR_PLUS},
+		{0x7ff1, 15, 0x0000, FR_ZERO | FR_OVER},
+		{0x8ff1, 0, 0x8ff1, FR_ZERO},
+		{0x8ff1, 1, 0xc7f8, FR_MINUS | FR_OVER},
+		{0x8ff1, 4, 0xf8ff, FR_MINUS},
+		{0x8ff1, 15, 0xffff, FR_MINUS},
+	}
+	for _, tc := range cases {
+		runShift(t, 0x51, tc)
+	}
+}
+
+func TestSLL(t *testing.T) {
+	cases := []shiftCase{
+		{0x8181, 0, 0x8181, FR_ZERO},
+		{0x8181, 1, 0x0302, FR_OVER},
+		{0x7e7e, 1, 0xfcfc, FR_MINUS},
+		{0x8181, 8, 0x8100, FR_MINUS | FR_OVER},
+		{0x7e7e, 8, 0x7e00, FR_PLUS},
+		{0x8181, 16, 0x0000, FR_ZERO | FR_OVER},
+		{0x7e7e, 16, 0x0000, FR_ZERO},
+	}
+	for _, tc := range cases {
+		runShift(t, 0x52, tc)
+	}
+}
+
+func TestSRL(t *testing.T) {
+	cases := []shiftCase{
+		{0x8181, 0, 0x8181, FR_ZERO},
+		{0x8181, 1, 0x40c0, FR_OVER},
+		{0x7e7e, 1, 0x3f3f, FR_PLUS},
+		{0x8181, 8, 0x0081, FR_OVER},
+		{0x7e7e, 8, 0x007e, FR_PLUS},
+		{0x8181, 16, 0x0000, FR_ZERO | FR_OVER},
+		{0x7e7e, 16, 0x0000, FR_ZERO},
+	}
+	for _, tc := range cases {
+		runShift(t, 0x53, tc)
+	}
+}
+
+func TestSLA(t *testing.T) {
+	cases := []shiftCase{
+		{0x1234, 0, 0x1234, FR_ZERO},
+		{0x4000, 1, 0x0000, FR_ZERO | FR_OVER},
+		{0x7fff, 1, 0x7ffe, FR_OVER},
+		{0x2001, 1, 0x4002, FR_PLUS},
+		{0xc001, 1, 0x8002, FR_MINUS | FR_OVER},
+		{0x8001, 4, 0x8010, FR_MINUS},
+		{0x0001, 15, 0x0000, FR_ZERO | FR_OVER},
+		{0xffff, 15, 0x8000, FR_MINUS | FR_OVER},
+		{0xfffe, 15, 0x8000, FR_MINUS},
+	}
+	for _, tc := range cases {
+		runShift(t, 0x50, tc)
+	}
+}
+
+func TestMultiModuleCall(t *testing.T) {
+	// Both modules define DATA; each must see its own
+	src := `MAIN	START
+	LD	GR1, DATA
+	CALL	SUB
+	ADDA	GR1, DATA
+	RET
+DATA	DC	1
+	END
+SUB	START	ENTRY
+DATA	DC	100
+ENTRY	LD	GR2, DATA
+	ADDA	GR1, GR2
+	RET
+	END
+`
+	bin, _, asmState, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	if got := expandLabel(asmState.symtbl, "SUB:SUB"); got != 9 {
+		t.Errorf("SUB = #%s, want #0009", hex(got, 4))
+	}
+	if bin[3] != 9 {
+		t.Errorf("CALL target = #%s, want #0009", hex(int(bin[3]), 4))
+	}
+
+	m := NewMachine(bin, 0)
+	if err := m.Run(0); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	gr1, _ := m.GR(1)
+	gr2, _ := m.GR(2)
+	if gr1 != 102 || gr2 != 100 {
+		t.Errorf("GR1, GR2 = %d, %d, want 102, 100", gr1, gr2)
+	}
+
+	// Only START labels are visible to CALL from other modules
+	_, _, _, err = assembleSource(t, "MAIN\tSTART\n\tCALL\tENTRY\n\tRET\n\tEND\nSUB\tSTART\nENTRY\tRET\n\tEND\n")
+	if err == nil || !strings.Contains(err.Error(), "Undefined label \"ENTRY\"") {
+		t.Errorf("Expected undefined label error, got %v", err)
+	}
+}
+
+func TestInputLimit(t *testing.T) {
+	m := NewMachine(nil, 0)
+	m.InputLimit = 8
+	m.SetGR(1, 0x100)
+	m.SetGR(2, 0x200)
+	m.Input("abcdefghijklmnopqrst")
+
+	if got := m.Read(0x200); got != 8 {
+		t.Errorf("length = %d, want 8", got)
+	}
+	if got := m.Read(0x107); got != 'h' {
+		t.Errorf("last character = %q, want 'h'", rune(got))
+	}
+	if got := m.Read(0x108); got != 0 {
+		t.Errorf("character after the limit = %q, want none", rune(got))
+	}
+}
+
+func TestIOHooks(t *testing.T) {
+	src := `MAIN	START
+	IN	BUF, LEN
+	OUT	BUF, LEN
+	IN	BUF, LEN
+	OUT	BUF, LEN
+	RET
+BUF	DS	8
+LEN	DS	1
+	END
+`
+	bin, _, _, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	inputs := []string{"one", "two"}
+	read := func() string {
+		line := inputs[0]
+		inputs = inputs[1:]
+		return line
+	}
+	var got []string
+	write := func(msg string) { got = append(got, msg) }
+
+	m := NewMachine(bin, 0)
+	m.In = read
+	m.Out = write
+	if err := m.Run(0); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(got) != 2 || got[0] != "one" || got[1] != "two" {
+		t.Errorf("output = %q, want [\"one\" \"two\"]", got)
+	}
+}
+
+func TestStrictDecoding(t *testing.T) {
+	// JUMP DATA / DATA DC 1, which decodes as NOP with GR1 as index
+	image := []uint16{0x6400, 0x0002, 0x0001}
+
+	m := NewMachine(image, 0)
+	for i := 0; i < 2; i++ {
+		if _, err := m.Execute(); err != nil {
+			t.Fatalf("Execute failed: %v", err)
+		}
+	}
+	if m.PC() != 3 {
+		t.Errorf("PC = #%s, want #0003", hex(int(m.PC()), 4))
+	}
+
+	m = NewMachine(image, 0)
+	m.Strict = true
+	if _, err := m.Execute(); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	_, err := m.Execute()
+	if err == nil || err.Error() != "Illegal instruction word #0001 at #0002" {
+		t.Errorf("Expected strict error, got %v", err)
+	}
+	if m.PC() != 2 {
+		t.Errorf("PC = #%s, want #0002", hex(int(m.PC()), 4))
+	}
+}
+
+func TestDivisionByZero(t *testing.T) {
+	src := `MAIN	START
+	LAD	GR1, 7
+	DIVA	GR1, =0
+	RET
+	END
+`
+	bin, _, _, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+
+	m := NewMachine(bin, 0)
+	err = m.Run(0)
+	if err == nil || err.Error() != "Division by zero in DIVA at #0002" {
+		t.Errorf("Expected division by zero error, got %v", err)
+	}
+	if gr1, _ := m.GR(1); m.PC() != 2 || gr1 != 7 {
+		t.Errorf("PC, GR1 = #%s, %d, want #0002, 7", hex(int(m.PC()), 4), gr1)
+	}
+	if !m.Finished || m.ExitStatus != SVC_EXIT_STATUS+EXIT_DVZ {
+		t.Errorf("Finished, ExitStatus = %v, %d, want true, %d", m.Finished, m.ExitStatus, SVC_EXIT_STATUS+EXIT_DVZ)
+	}
+
+	// DivContinue keeps the flags-only behavior with a warning
+	m = NewMachine(bin, 0)
+	m.DivContinue = true
+	var warnings []string
+	m.Warn = func(msg string) { warnings = append(warnings, msg) }
+	for i := 0; i < 2; i++ {
+		if err := m.Step(); err != nil {
+			t.Fatalf("Step failed: %v", err)
+		}
+	}
+	if m.PC() != 4 || m.FR() != FR_OVER|FR_ZERO {
+		t.Errorf("PC, FR = #%s, %d, want #0004, %d", hex(int(m.PC()), 4), m.FR(), FR_OVER|FR_ZERO)
+	}
+	if len(warnings) != 1 || warnings[0] != "Division by zero in DIVA at #0002" {
+		t.Errorf("warnings = %q, want the division by zero", warnings)
+	}
+}
+
+func TestDirectSVC(t *testing.T) {
+	src := `MAIN	START
+	LAD	GR1, BUF
+	LAD	GR2, LEN
+	SVC	#FFF0
+	LAD	GR1, BUF
+	LAD	GR2, LEN
+	SVC	#FFF2
+	IN	BUF2, LEN2
+	OUT	BUF2, LEN2
+	RET
+BUF	DS	8
+LEN	DS	1
+BUF2	DS	8
+LEN2	DS	1
+	END
+`
+	bin, _, asmState, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	read := func() string { return "héllo" }
+	var got []string
+	write := func(msg string) { got = append(got, msg) }
+
+	m := NewMachine(bin, 0)
+	m.In = read
+	m.Out = write
+	if err := m.Run(0); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	// The direct SVC and the macro store and write the same bytes
+	if len(got) != 2 || got[0] != "héllo" || got[1] != "héllo" {
+		t.Errorf("output = %q, want [\"héllo\" \"héllo\"]", got)
+	}
+	lenAddr := expandLabel(asmState.symtbl, "MAIN:LEN")
+	len2Addr := expandLabel(asmState.symtbl, "MAIN:LEN2")
+	if m.Read(uint16(lenAddr)) != 6 || m.Read(uint16(len2Addr)) != 6 {
+		t.Errorf("lengths = %d, %d, want 6, 6", m.Read(uint16(lenAddr)), m.Read(uint16(len2Addr)))
+	}
+}
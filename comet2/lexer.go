@@ -1,14 +1,15 @@
-// Package main provides the CASL2 assembler and COMET2 emulator.
+// Package comet2 provides the CASL2 assembler and COMET2 emulator.
 // 
 // This file contains an LL(1) lexer and parser for CASL2 that was developed
-// to remove regex dependencies. It is currently not used by the main assembler
-// but is kept for potential future refactoring. The assembler.go file uses
-// a proven regex-based parser for stability.
-package main
+// to remove regex dependencies. The main assembler only uses it to locate
+// syntax errors by column; assembler.go otherwise uses a proven regex-based
+// parser for stability.
+package comet2
 
 import (
 	"fmt"
 	"strings"
+	"unicode/utf8"
 )
 
 // TokenType represents the type of a token
@@ -22,6 +23,7 @@ const (
 	TOKEN_REGISTER
 	TOKEN_NUMBER
 	TOKEN_HEXNUM
+	TOKEN_BINNUM
 	TOKEN_STRING
 	TOKEN_COMMA
 	TOKEN_EQUALS
@@ -106,6 +108,11 @@ func isHexDigit(ch byte) bool {
 	return (ch >= '0' && ch <= '9') || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
 }
 
+// isBinaryDigit checks if a character is a binary digit
+func isBinaryDigit(ch byte) bool {
+	return ch == '0' || ch == '1'
+}
+
 // isLabelChar checks if a character can be part of a label
 func isLabelChar(ch byte) bool {
 	return isLetter(ch) || isDigit(ch)
@@ -116,12 +123,20 @@ func isWhitespace(ch byte) bool {
 	return ch == ' ' || ch == '\t'
 }
 
+// fullWidthSpace is the ideographic space often typed by Japanese IMEs
+const fullWidthSpace = "\u3000"
+
+// atWhitespace checks if the input continues with an ASCII or full-width space
+func (l *Lexer) atWhitespace() bool {
+	return isWhitespace(l.peek()) || strings.HasPrefix(l.input[l.pos:], fullWidthSpace)
+}
+
 // NextToken returns the next token from the input
 func (l *Lexer) NextToken() Token {
 	ch := l.peek()
 
 	// Skip whitespace but track it
-	if isWhitespace(ch) {
+	if l.atWhitespace() {
 		return l.scanWhitespace()
 	}
 
@@ -164,6 +179,11 @@ func (l *Lexer) NextToken() Token {
 		return l.scanHexNumber()
 	}
 
+	// Handle binary numbers; anything else starting with % is a label
+	if ch == '%' && l.atBinaryNumber() {
+		return l.scanBinaryNumber()
+	}
+
 	// Handle numbers (including signed)
 	if isDigit(ch) || ((ch == '+' || ch == '-') && isDigit(l.peekN(1))) {
 		return l.scanNumber()
@@ -176,10 +196,12 @@ func (l *Lexer) NextToken() Token {
 
 	// Unknown character - return as error
 	line, col := l.line, l.column
-	l.advance()
+	r, size := utf8.DecodeRuneInString(l.input[l.pos:])
+	l.pos += size
+	l.column++
 	return Token{
 		Type:   TOKEN_EOF,
-		Value:  fmt.Sprintf("unexpected character: %c", ch),
+		Value:  fmt.Sprintf("unexpected character '%c'", r),
 		Line:   line,
 		Column: col,
 	}
@@ -189,8 +211,14 @@ func (l *Lexer) NextToken() Token {
 func (l *Lexer) scanWhitespace() Token {
 	line, col := l.line, l.column
 	start := l.pos
-	for isWhitespace(l.peek()) {
-		l.advance()
+	for l.atWhitespace() {
+		if isWhitespace(l.peek()) {
+			l.advance()
+		} else {
+			// One column for the whole multi-byte character
+			l.pos += len(fullWidthSpace)
+			l.column++
+		}
 	}
 	return Token{
 		Type:   TOKEN_WHITESPACE,
@@ -283,6 +311,34 @@ func (l *Lexer) scanHexNumber() Token {
 	}
 }
 
+// atBinaryNumber reports whether the % at the current position starts a
+// binary number: one or more 0s and 1s not followed by other label characters
+func (l *Lexer) atBinaryNumber() bool {
+	i := l.pos + 1
+	for i < len(l.input) && isBinaryDigit(l.input[i]) {
+		i++
+	}
+	return i > l.pos+1 && (i == len(l.input) || !isLabelChar(l.input[i]))
+}
+
+// scanBinaryNumber scans a binary number
+func (l *Lexer) scanBinaryNumber() Token {
+	line, col := l.line, l.column
+	start := l.pos
+	l.advance() // skip '%'
+
+	for isBinaryDigit(l.peek()) {
+		l.advance()
+	}
+
+	return Token{
+		Type:   TOKEN_BINNUM,
+		Value:  l.input[start:l.pos],
+		Line:   line,
+		Column: col,
+	}
+}
+
 // scanNumber scans a decimal number
 func (l *Lexer) scanNumber() Token {
 	line, col := l.line, l.column
@@ -348,6 +404,16 @@ func (l *Lexer) scanIdentifier() Token {
 	}
 }
 
+// SyntaxError is returned by ParseLine with the column of the offending token
+type SyntaxError struct {
+	Column int
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("col %d: %s", e.Column, e.Msg)
+}
+
 // ParsedLine represents a parsed line of CASL2 code
 type ParsedLine struct {
 	Label       string
@@ -368,6 +434,9 @@ func ParseLine(line string, lineNum int) (*ParsedLine, error) {
 	for {
 		tok := lexer.NextToken()
 		if tok.Type == TOKEN_EOF {
+			if tok.Value != "" {
+				return nil, &SyntaxError{tok.Column, tok.Value}
+			}
 			break
 		}
 		if tok.Type == TOKEN_COMMENT {
@@ -395,10 +464,10 @@ func ParseLine(line string, lineNum int) (*ParsedLine, error) {
 	// If line starts with whitespace, first token is instruction
 	// Otherwise, first token could be label or instruction
 	if !hasLeadingWhitespace && pos < len(tokens) && tokens[pos].Type == TOKEN_LABEL {
-		// Check if this is an instruction by checking CASL2TBL
+		// Check if this is an instruction by checking casl2tbl
 		if isInstruction(tokens[pos].Value) {
 			// It's an instruction (no label)
-			result.Instruction = tokens[pos].Value
+			result.Instruction = strings.ToUpper(tokens[pos].Value)
 			pos++
 		} else {
 			// It's a label
@@ -408,7 +477,7 @@ func ParseLine(line string, lineNum int) (*ParsedLine, error) {
 			// Next token should be instruction if present
 			if pos < len(tokens) && tokens[pos].Type == TOKEN_LABEL {
 				if isInstruction(tokens[pos].Value) {
-					result.Instruction = tokens[pos].Value
+					result.Instruction = strings.ToUpper(tokens[pos].Value)
 					pos++
 				}
 			}
@@ -416,52 +485,64 @@ func ParseLine(line string, lineNum int) (*ParsedLine, error) {
 	} else if hasLeadingWhitespace && pos < len(tokens) && tokens[pos].Type == TOKEN_LABEL {
 		// Leading whitespace means first token must be instruction
 		if isInstruction(tokens[pos].Value) {
-			result.Instruction = tokens[pos].Value
+			result.Instruction = strings.ToUpper(tokens[pos].Value)
 			pos++
 		} else {
-			return nil, fmt.Errorf("expected instruction after leading whitespace, got %s", tokens[pos].Value)
+			return nil, &SyntaxError{tokens[pos].Column, fmt.Sprintf("expected instruction after leading whitespace, got %s", tokens[pos].Value)}
 		}
 	}
 
-	// Parse operands
+	// Parse operands, which must be separated by single commas
+	needOperand := true
+	lastComma := 0
 	for pos < len(tokens) {
 		tok := tokens[pos]
 		
 		// Handle literals (=...)
 		if tok.Type == TOKEN_EQUALS {
 			if pos+1 >= len(tokens) {
-				return nil, fmt.Errorf("expected value after =")
+				return nil, &SyntaxError{tok.Column, "expected value after ="}
 			}
 			nextTok := tokens[pos+1]
 			var literal string
-			if nextTok.Type == TOKEN_NUMBER || nextTok.Type == TOKEN_HEXNUM || nextTok.Type == TOKEN_STRING {
+			if nextTok.Type == TOKEN_NUMBER || nextTok.Type == TOKEN_HEXNUM || nextTok.Type == TOKEN_BINNUM || nextTok.Type == TOKEN_STRING {
 				literal = "=" + nextTok.Value
 				pos += 2
 			} else if nextTok.Type == TOKEN_LABEL {
 				literal = "=" + nextTok.Value
 				pos += 2
 			} else {
-				return nil, fmt.Errorf("invalid literal value")
+				return nil, &SyntaxError{nextTok.Column, "invalid literal value"}
 			}
 			result.Operands = append(result.Operands, literal)
+			needOperand = false
 		} else if tok.Type == TOKEN_COMMA {
+			if needOperand {
+				return nil, &SyntaxError{tok.Column, "unexpected token ','"}
+			}
+			needOperand = true
+			lastComma = tok.Column
 			pos++
 		} else if tok.Type == TOKEN_REGISTER || tok.Type == TOKEN_LABEL || 
 				  tok.Type == TOKEN_NUMBER || tok.Type == TOKEN_HEXNUM || 
-				  tok.Type == TOKEN_STRING {
+				  tok.Type == TOKEN_BINNUM || tok.Type == TOKEN_STRING {
 			result.Operands = append(result.Operands, tok.Value)
+			needOperand = false
 			pos++
 		} else {
-			return nil, fmt.Errorf("unexpected token: %s", tok.Value)
+			return nil, &SyntaxError{tok.Column, fmt.Sprintf("unexpected token '%s'", tok.Value)}
 		}
 	}
+	if needOperand && lastComma > 0 {
+		return nil, &SyntaxError{lastComma, "unexpected token ','"}
+	}
 
 	return result, nil
 }
 
 // isInstruction checks if a string is a known CASL2 instruction
 func isInstruction(s string) bool {
-	_, exists := CASL2TBL[s]
+	_, exists := casl2tbl[strings.ToUpper(s)]
 	return exists
 }
 
@@ -0,0 +1,107 @@
+package comet2
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLineNumbers(t *testing.T) {
+	parsed, err := ParseLine("\tDC\t1, -2, #3", 1)
+	if err != nil {
+		t.Fatalf("ParseLine failed: %v", err)
+	}
+	if parsed.Instruction != "DC" {
+		t.Errorf("Instruction = %q, want DC", parsed.Instruction)
+	}
+	want := []string{"1", "-2", "#3"}
+	if !reflect.DeepEqual(parsed.Operands, want) {
+		t.Errorf("Operands = %q, want %q", parsed.Operands, want)
+	}
+}
+
+func TestParseLineLowercase(t *testing.T) {
+	parsed, err := ParseLine("LOOP\tld\tgr1, DATA", 1)
+	if err != nil {
+		t.Fatalf("ParseLine failed: %v", err)
+	}
+	if parsed.Label != "LOOP" || parsed.Instruction != "LD" {
+		t.Errorf("Label, Instruction = %q, %q, want LOOP, LD", parsed.Label, parsed.Instruction)
+	}
+}
+
+func TestParseLineSyntaxError(t *testing.T) {
+	cases := []struct {
+		line string
+		col  int
+	}{
+		{"\tLD\tGR1, , X", 10},
+		{"\tLD\tGR1, X,", 11},
+		{"\tLD\t@GR1", 5},
+	}
+	for _, c := range cases {
+		_, err := ParseLine(c.line, 1)
+		synErr, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("%q: error = %v, want SyntaxError", c.line, err)
+			continue
+		}
+		if synErr.Column != c.col {
+			t.Errorf("%q: column = %d, want %d", c.line, synErr.Column, c.col)
+		}
+	}
+}
+
+func TestParseLineStringLiteral(t *testing.T) {
+	parsed, err := ParseLine("\tLD\tGR1, =',' ; comma", 1)
+	if err != nil {
+		t.Fatalf("ParseLine failed: %v", err)
+	}
+	want := []string{"GR1", "=','"}
+	if !reflect.DeepEqual(parsed.Operands, want) {
+		t.Errorf("Operands = %q, want %q", parsed.Operands, want)
+	}
+
+	parsed, err = ParseLine("PTR\tDC\t='a,b'", 1)
+	if err != nil {
+		t.Fatalf("ParseLine failed: %v", err)
+	}
+	if want := []string{"='a,b'"}; !reflect.DeepEqual(parsed.Operands, want) {
+		t.Errorf("Operands = %q, want %q", parsed.Operands, want)
+	}
+}
+
+func TestParseLineFullWidthSpace(t *testing.T) {
+	parsed, err := ParseLine("LOOP　LD　GR1,　DATA", 1)
+	if err != nil {
+		t.Fatalf("ParseLine failed: %v", err)
+	}
+	if parsed.Label != "LOOP" || parsed.Instruction != "LD" {
+		t.Errorf("Label, Instruction = %q, %q, want LOOP, LD", parsed.Label, parsed.Instruction)
+	}
+	if want := []string{"GR1", "DATA"}; !reflect.DeepEqual(parsed.Operands, want) {
+		t.Errorf("Operands = %q, want %q", parsed.Operands, want)
+	}
+
+	// Columns count characters, not bytes
+	_, err = ParseLine("　LD　GR1,,DATA", 1)
+	if synErr, ok := err.(*SyntaxError); !ok || synErr.Column != 9 {
+		t.Errorf("error = %v, want col 9", err)
+	}
+}
+
+func TestLexBinaryNumber(t *testing.T) {
+	cases := []struct {
+		input string
+		typ   TokenType
+	}{
+		{"%1010", TOKEN_BINNUM},
+		{"%10A", TOKEN_LABEL},
+		{"%ABC", TOKEN_LABEL},
+	}
+	for _, c := range cases {
+		tok := NewLexer(c.input).NextToken()
+		if tok.Type != c.typ || tok.Value != c.input {
+			t.Errorf("%q: token %d %q, want %d %q", c.input, tok.Type, tok.Value, c.typ, c.input)
+		}
+	}
+}
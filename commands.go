@@ -2,25 +2,57 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
+
+	"github.com/f0reachARR/casljs/comet2"
 )
 
 func executeCommand(cmd string, args []string, memory []uint16, state []int) error {
 	commands := map[string]func([]uint16, []int, []string) error{
-		"r":    cmdRun,
-		"run":  cmdRun,
-		"s":    cmdStep,
-		"step": cmdStep,
-		"p":    cmdPrint,
-		"print": cmdPrint,
-		"h":    cmdHelp,
-		"help": cmdHelp,
-		"du":   cmdDump,
-		"dump": cmdDump,
-		"st":   cmdStack,
-		"stack": cmdStack,
-		"di":    cmdDisasm,
-		"disasm": cmdDisasm,
+		"r":         cmdRun,
+		"run":       cmdRun,
+		"c":         cmdRun,
+		"continue":  cmdRun,
+		"s":         cmdStep,
+		"step":      cmdStep,
+		"p":         cmdPrint,
+		"print":     cmdPrint,
+		"h":         cmdHelp,
+		"help":      cmdHelp,
+		"du":        cmdDump,
+		"dump":      cmdDump,
+		"st":        cmdStack,
+		"stack":     cmdStack,
+		"di":        cmdDisasm,
+		"disasm":    cmdDisasm,
+		"b":         cmdBreak,
+		"break":     cmdBreak,
+		"d":         cmdDelete,
+		"delete":    cmdDelete,
+		"i":         cmdInfo,
+		"info":      cmdInfo,
+		"set":       cmdSet,
+		"fill":      cmdFill,
+		"history":   cmdHistoryList,
+		"x":         cmdExamine,
+		"examine":   cmdExamine,
+		"search":    cmdSearch,
+		"watch":     cmdWatch,
+		"reset":     cmdReset,
+		"format":    cmdFormat,
+		"save":      cmdSave,
+		"load":      cmdLoad,
+		"goto":      cmdGoto,
+		"n":         cmdNext,
+		"next":      cmdNext,
+		"finish":    cmdFinish,
+		"stepout":   cmdFinish,
+		"back":      cmdBack,
+		"rs":        cmdBack,
+		"bt":        cmdBacktrace,
+		"backtrace": cmdBacktrace,
 	}
 
 	if handler, ok := commands[cmd]; ok {
@@ -31,26 +63,110 @@ func executeCommand(cmd string, args []string, memory []uint16, state []int) err
 }
 
 func cmdRun(memory []uint16, state []int, args []string) error {
-	nextCmd = "run"
-	stopFlag, err := stepExec(memory, state)
+	for {
+		// Resuming from the breakpoint we stopped at must not stop again
+		if breakpoints[state[comet2.PC]] && state[comet2.PC] != breakpointStop {
+			stopRun()
+			breakpointStop = state[comet2.PC]
+			cometPrint(fmt.Sprintf("Breakpoint at #%s", hex(state[comet2.PC], 4)))
+			return cmdPrint(memory, state, []string{})
+		}
+		breakpointStop = -1
+
+		// A recursive call may pass the target in a deeper frame
+		if state[comet2.PC] == runTarget && state[comet2.SP] >= runTargetSP {
+			stopRun()
+			cometPrint(fmt.Sprintf("Reached #%s", hex(state[comet2.PC], 4)))
+			return cmdPrint(memory, state, []string{})
+		}
+
+		if *optSteps > 0 && runStepCount >= *optSteps {
+			stopRun()
+			return fmt.Errorf("Execution limit reached (%d steps) at #%s", *optSteps, hex(state[comet2.PC], 4))
+		}
+		runStepCount++
+
+		pc := state[comet2.PC]
+		instWord := memGet(memory, pc)
+		isRet := instWord>>8 == 0x81
+		stopFlag, err := stepExec()
+		if err != nil {
+			stopRun()
+			return err
+		}
+
+		// -trapov stops at the instruction that set OF, like the ROV exit;
+		// OF left over from an earlier instruction does not count
+		if *optTrapOv && comet2.SetsFlags(instWord) && state[comet2.FR]&comet2.FR_OVER != 0 {
+			stopRun()
+			return &comet2.Fault{Msg: fmt.Sprintf("Arithmetic overflow at #%s", hex(pc, 4)), Status: comet2.SVC_EXIT_STATUS + comet2.EXIT_ROV}
+		}
+
+		// Only the RET that pops above the frame finish started in counts
+		if finishSP >= 0 && isRet && state[comet2.SP] > finishSP {
+			stopRun()
+			cometPrint(fmt.Sprintf("Returned to #%s", hex(state[comet2.PC], 4)))
+			return cmdPrint(memory, state, []string{})
+		}
+
+		if checkWatchpoints(memory) {
+			stopRun()
+			return cmdPrint(memory, state, []string{})
+		}
+
+		if stopFlag {
+			// exec_in will handle this, then resume running
+			nextCmd = "run"
+			return nil
+		}
+	}
+}
+
+// stopRun ends a run, goto, next or finish so that it is not resumed after input
+func stopRun() {
+	nextCmd = ""
+	runTarget = -1
+	finishSP = -1
+}
+
+func cmdGoto(memory []uint16, state []int, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Usage: goto ADDRESS")
+	}
+	addr, err := parseAddress(args[0])
 	if err != nil {
-		nextCmd = ""
 		return err
 	}
+	if addr == state[comet2.PC] {
+		return fmt.Errorf("Already at #%s", hex(addr, 4))
+	}
 
-	if stopFlag {
-		// exec_in will handle this
-		return nil
+	runTarget = addr
+	runTargetSP = 0
+	return cmdRun(memory, state, args)
+}
+
+func cmdFinish(memory []uint16, state []int, args []string) error {
+	finishSP = state[comet2.SP]
+	return cmdRun(memory, state, args)
+}
+
+func cmdNext(memory []uint16, state []int, args []string) error {
+	inst, _, size := comet2.Disassemble(memory, state)
+	if inst != "CALL" {
+		return cmdStep(memory, state, args)
 	}
 
-	// Check for breakpoints (not implemented in minimal version)
-	return nil
+	// Run the whole subroutine and stop after the CALL
+	runTarget = state[comet2.PC] + size
+	runTargetSP = state[comet2.SP]
+	return cmdRun(memory, state, args)
 }
 
 func cmdStep(memory []uint16, state []int, args []string) error {
 	count := 1
 	if len(args) > 0 {
-		if n, ok := expandNumber(args[0]); ok {
+		if n, ok := comet2.ExpandNumber(args[0]); ok {
 			count = n
 		}
 	}
@@ -62,10 +178,11 @@ func cmdStep(memory []uint16, state []int, args []string) error {
 		nextCmd = ""
 	}
 
-	_, err := stepExec(memory, state)
+	_, err := stepExec()
 	if err != nil {
 		return err
 	}
+	checkWatchpoints(memory)
 
 	if !*optQuiet {
 		cmdPrint(memory, state, []string{})
@@ -74,14 +191,40 @@ func cmdStep(memory []uint16, state []int, args []string) error {
 	return nil
 }
 
+func cmdBack(memory []uint16, state []int, args []string) error {
+	count := 1
+	if len(args) > 0 {
+		if n, ok := comet2.ExpandNumber(args[0]); ok {
+			count = n
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		if !undoStep(memory, state) {
+			if i == 0 {
+				return fmt.Errorf("No earlier step to go back to")
+			}
+			break
+		}
+	}
+	for i := range watchpoints {
+		watchpoints[i].lastVal = memGet(memory, watchpoints[i].addr)
+	}
+
+	if !*optQuiet {
+		cmdPrint(memory, state, []string{})
+	}
+	return nil
+}
+
 func cmdPrint(memory []uint16, state []int, args []string) error {
-	pc := state[PC]
-	fr := state[FR]
-	sp := state[SP]
-	regs := state[GR0 : GR7+1]
+	pc := state[comet2.PC]
+	fr := state[comet2.FR]
+	sp := state[comet2.SP]
+	regs := state[comet2.GR0 : comet2.GR7+1]
 
 	// Get current instruction
-	inst, opr, _ := parse(memory, state)
+	inst, opr, _ := comet2.Disassemble(memory, state)
 
 	cometPrint("")
 	cometPrint(fmt.Sprintf("%s  %s [ %s ]",
@@ -89,66 +232,133 @@ func cmdPrint(memory []uint16, state []int, args []string) error {
 		colorRed("#"+hex(pc, 4)),
 		colorGreen(fmt.Sprintf("%s\t\t%s", inst, opr))))
 
-	frBin := fmt.Sprintf("%d%d%d", (fr>>2)%2, (fr>>1)%2, fr%2)
-	frStr := ""
-	if (fr>>2)%2 == 1 {
-		frStr += "O"
-	} else {
-		frStr += "-"
-	}
-	if (fr>>1)%2 == 1 {
-		frStr += "S"
-	} else {
-		frStr += "-"
-	}
-	if fr%2 == 1 {
-		frStr += "Z"
-	} else {
-		frStr += "-"
-	}
+	frBin := fmt.Sprintf("%d%d%d", flagBit(fr, comet2.FR_OVER), flagBit(fr, comet2.FR_MINUS), flagBit(fr, comet2.FR_ZERO))
+	frStr := flagLetters(fr)
 
-	cometPrint(fmt.Sprintf("%s  %s(%s)  %s    %s(%s)[ %s ]",
+	cometPrint(fmt.Sprintf("%s  %s  %s    %s(%s)[ %s ]",
 		colorBCyan("SP"),
-		colorRed("#"+hex(sp, 4)),
-		spacePadding(signed(sp), 6),
+		formatWord(sp),
 		colorBCyan("FR"),
 		colorYellow(frBin),
 		spacePadding(fr, 6),
 		colorGreen(frStr)))
+	cometPrint(fmt.Sprintf("%s = %s", colorBCyan("FR"), flagNames(fr)))
+
+	cometPrint(fmt.Sprintf("%s %s  %s %s  %s %s  %s %s",
+		colorBCyan("GR0"), formatWord(regs[0]),
+		colorBCyan("GR1"), formatWord(regs[1]),
+		colorBCyan("GR2"), formatWord(regs[2]),
+		colorBCyan("GR3"), formatWord(regs[3])))
+
+	cometPrint(fmt.Sprintf("%s %s  %s %s  %s %s  %s %s",
+		colorBCyan("GR4"), formatWord(regs[4]),
+		colorBCyan("GR5"), formatWord(regs[5]),
+		colorBCyan("GR6"), formatWord(regs[6]),
+		colorBCyan("GR7"), formatWord(regs[7])))
+
+	return nil
+}
+
+// flagLetters shows the set OF/SF/ZF bits of fr as "OSZ" with "-" for clear bits
+func flagLetters(fr int) string {
+	frStr := ""
+	for _, f := range []struct {
+		mask   int
+		letter string
+	}{{comet2.FR_OVER, "O"}, {comet2.FR_MINUS, "S"}, {comet2.FR_ZERO, "Z"}} {
+		if fr&f.mask != 0 {
+			frStr += f.letter
+		} else {
+			frStr += "-"
+		}
+	}
+	return frStr
+}
 
-	cometPrint(fmt.Sprintf("%s %s(%s)  %s %s(%s)  %s %s(%s)  %s %s(%s)",
-		colorBCyan("GR0"), colorRed("#"+hex(regs[0], 4)), spacePadding(signed(regs[0]), 6),
-		colorBCyan("GR1"), colorRed("#"+hex(regs[1], 4)), spacePadding(signed(regs[1]), 6),
-		colorBCyan("GR2"), colorRed("#"+hex(regs[2], 4)), spacePadding(signed(regs[2]), 6),
-		colorBCyan("GR3"), colorRed("#"+hex(regs[3], 4)), spacePadding(signed(regs[3]), 6)))
+// flagNames shows each flag of fr by name, e.g. "OF=0 SF=1 ZF=0"
+func flagNames(fr int) string {
+	return fmt.Sprintf("OF=%d SF=%d ZF=%d", flagBit(fr, comet2.FR_OVER), flagBit(fr, comet2.FR_MINUS), flagBit(fr, comet2.FR_ZERO))
+}
 
-	cometPrint(fmt.Sprintf("%s %s(%s)  %s %s(%s)  %s %s(%s)  %s %s(%s)",
-		colorBCyan("GR4"), colorRed("#"+hex(regs[4], 4)), spacePadding(signed(regs[4]), 6),
-		colorBCyan("GR5"), colorRed("#"+hex(regs[5], 4)), spacePadding(signed(regs[5]), 6),
-		colorBCyan("GR6"), colorRed("#"+hex(regs[6], 4)), spacePadding(signed(regs[6]), 6),
-		colorBCyan("GR7"), colorRed("#"+hex(regs[7], 4)), spacePadding(signed(regs[7]), 6)))
+// flagBit returns 1 if the flag with the given mask is set in fr
+func flagBit(fr, mask int) int {
+	if fr&mask != 0 {
+		return 1
+	}
+	return 0
+}
 
+// formatWord renders a register value in the representation chosen by format
+func formatWord(val int) string {
+	switch displayFormat {
+	case "dec":
+		return colorRed(spacePadding(signed(val), 6))
+	case "bin":
+		return colorRed(fmt.Sprintf("%016b", val&0xffff))
+	case "char":
+		ch := val & 0xff
+		if ch < 0x20 || ch > 0x7e {
+			ch = '.'
+		}
+		return colorRed(fmt.Sprintf("'%c'", ch))
+	default:
+		return colorRed("#"+hex(val, 4)) + "(" + spacePadding(signed(val), 6) + ")"
+	}
+}
+
+func cmdFormat(memory []uint16, state []int, args []string) error {
+	if len(args) == 0 {
+		cometPrint(fmt.Sprintf("Register format is %s.", displayFormat))
+		return nil
+	}
+	switch args[0] {
+	case "hex", "dec", "bin", "char":
+		displayFormat = args[0]
+	default:
+		return fmt.Errorf("Unknown format \"%s\". Use hex, dec, bin or char.", args[0])
+	}
 	return nil
 }
 
 func cmdDump(memory []uint16, state []int, args []string) error {
-	val := state[PC]
+	val := state[comet2.PC]
 	if len(args) > 0 {
-		if n, ok := expandNumber(args[0]); ok {
-			val = n
+		addr, err := parseAddress(args[0])
+		if err != nil {
+			return err
+		}
+		val = addr
+	}
+	words := 128
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("Invalid count \"%s\"", args[1])
 		}
+		words = n
+	}
+	// Stop at the end of memory
+	if val+words > comet2.MEMORY_SIZE {
+		words = comet2.MEMORY_SIZE - val
 	}
 
-	for row := 0; row < 16; row++ {
-		base := val + (row << 3)
+	for base := val; base < val+words; base += 8 {
+		cols := 8
+		if val+words-base < cols {
+			cols = val + words - base
+		}
 		line := hex(base, 4) + ":"
 
 		for col := 0; col < 8; col++ {
-			line += " " + hex(memGet(memory, base+col), 4)
+			if col < cols {
+				line += " " + hex(memGet(memory, base+col), 4)
+			} else {
+				line += "     "
+			}
 		}
 
 		line += " "
-		for col := 0; col < 8; col++ {
+		for col := 0; col < cols; col++ {
 			c := memGet(memory, base+col) & 0xff
 			if c >= 0x20 && c <= 0x7f {
 				line += string(rune(c))
@@ -163,42 +373,662 @@ func cmdDump(memory []uint16, state []int, args []string) error {
 	return nil
 }
 
+// Number of stack words shown by stack
+const STACK_SHOWN = 128
+
+// cmdStack lists the stack one word per row from SP, the top of the stack,
+// down to the bottom at the initial SP
 func cmdStack(memory []uint16, state []int, args []string) error {
-	return cmdDump(memory, state, []string{strconv.Itoa(state[SP])})
+	sp := state[comet2.SP]
+	if sp >= machine.StackTop {
+		cometPrint(fmt.Sprintf("Stack is empty (SP = #%s)", hex(sp, 4)))
+		return nil
+	}
+
+	cometPrint(fmt.Sprintf("Stack from SP #%s to #%s (%d words)", hex(sp, 4), hex(machine.StackTop, 4), machine.StackTop-sp))
+	for addr := sp; addr < machine.StackTop && addr < sp+STACK_SHOWN; addr++ {
+		marker := "     "
+		if addr == sp {
+			marker = "SP ->"
+		}
+		val := memGet(memory, addr)
+		cometPrint(fmt.Sprintf("%s #%s: #%s %6d", marker, hex(addr, 4), hex(val, 4), signed(val)))
+	}
+	if machine.StackTop-sp > STACK_SHOWN {
+		cometPrint(fmt.Sprintf("      ... %d more words", machine.StackTop-sp-STACK_SHOWN))
+	}
+	return nil
+}
+
+func cmdBacktrace(memory []uint16, state []int, args []string) error {
+	cometPrint(fmt.Sprintf("#0  #%s%s", hex(state[comet2.PC], 4), sourceLine(state[comet2.PC])))
+
+	// A stacked word is a return address if the two words before it are a CALL
+	frame := 1
+	for sp := state[comet2.SP]; sp < machine.StackTop; sp++ {
+		ret := memGet(memory, sp)
+		if ret < 2 || memGet(memory, ret-2)>>8 != 0x80 {
+			continue
+		}
+		cometPrint(fmt.Sprintf("#%d  #%s%s", frame, hex(ret-2, 4), sourceLine(ret-2)))
+		frame++
+	}
+	return nil
+}
+
+// sourceLine returns " (line N)" for the source of addr, or "" when the
+// program was not assembled in this session
+func sourceLine(addr int) string {
+	if comet2asm == nil {
+		return ""
+	}
+	word, ok := comet2asm.Word(addr)
+	if !ok {
+		return ""
+	}
+	if word.File != comet2asm.MainFile() {
+		return fmt.Sprintf(" (%s:%d)", word.File, word.Line)
+	}
+	return fmt.Sprintf(" (line %d)", word.Line)
 }
 
 func cmdDisasm(memory []uint16, state []int, args []string) error {
-	val := state[PC]
+	val := state[comet2.PC]
 	if len(args) > 0 {
-		if n, ok := expandNumber(args[0]); ok {
-			val = n
+		addr, err := parseAddress(args[0])
+		if err != nil {
+			return err
 		}
+		val = addr
+	}
+	count := 16
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("Invalid count \"%s\"", args[1])
+		}
+		count = n
 	}
 
 	// Save original PC
-	origPC := state[PC]
-	state[PC] = val
+	origPC := state[comet2.PC]
+	state[comet2.PC] = val
 
-	for i := 0; i < 16; i++ {
-		inst, opr, size := parse(memory, state)
-		cometPrint(fmt.Sprintf("#%s\t%s\t%s", hex(state[PC], 4), inst, opr))
-		state[PC] += size
+	labels := addressLabels()
+	for i := 0; i < count && state[comet2.PC] < comet2.MEMORY_SIZE; i++ {
+		if name, ok := labels[state[comet2.PC]]; ok {
+			cometPrint(name + ":")
+		}
+		inst, opr, size := comet2.Disassemble(memory, state)
+		if size == 2 {
+			adr := memGet(memory, state[comet2.PC]+1)
+			if name, ok := labels[adr]; ok {
+				target := "#" + hex(adr, 4)
+				opr = strings.Replace(opr, target, target+" ("+name+")", 1)
+			}
+		}
+		if opr != "" {
+			inst = fmt.Sprintf("%-5s", inst)
+		}
+		cometPrint(strings.TrimRight(fmt.Sprintf("#%s  %s %s", hex(state[comet2.PC], 4), colorGreen(inst), opr), " "))
+		state[comet2.PC] += size
 	}
 
 	// Restore PC
-	state[PC] = origPC
+	state[comet2.PC] = origPC
+
+	return nil
+}
+
+func cmdExamine(memory []uint16, state []int, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Usage: x ADDRESS|REGISTER")
+	}
+	// A register examines the word it points to, e.g. x SP
+	var addr int
+	if reg, ok := registerIndex(args[0]); ok && reg != comet2.FR {
+		addr = state[reg]
+	} else {
+		var err error
+		addr, err = parseAddress(args[0])
+		if err != nil {
+			return err
+		}
+	}
 
+	where := "#" + hex(addr, 4)
+	if label, ok := addressLabels()[addr]; ok {
+		where += " <" + label + ">"
+	}
+	val := memGet(memory, addr)
+	line := fmt.Sprintf("%s: #%s %d", where, hex(val, 4), signed(val))
+
+	if comet2.ValidEncoding(val) {
+		tmp := make([]int, comet2.SP+1)
+		tmp[comet2.PC] = addr
+		inst, opr, _ := comet2.Disassemble(memory, tmp)
+		line += "\t" + strings.TrimSpace(inst+"\t"+opr)
+	}
+	cometPrint(line)
+	return nil
+}
+
+// addressLabels maps addresses to the labels defined there, or is empty when
+// the program was not assembled in this session
+func addressLabels() map[int]string {
+	labels := make(map[int]string)
+	if comet2asm == nil {
+		return labels
+	}
+	symbols := comet2asm.Symbols()
+	// START labels, then the first name in order, win when several labels
+	// share an address
+	isStart := func(sym comet2.Symbol) bool {
+		return sym.Scope == sym.Name
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		if isStart(symbols[i]) != isStart(symbols[j]) {
+			return isStart(symbols[i])
+		}
+		return symbols[i].Scope+":"+symbols[i].Name < symbols[j].Scope+":"+symbols[j].Name
+	})
+	for _, sym := range symbols {
+		if _, exists := labels[sym.Address]; !exists {
+			labels[sym.Address] = sym.Name
+		}
+	}
+	return labels
+}
+
+func cmdBreak(memory []uint16, state []int, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Usage: break ADDRESS")
+	}
+	addr, err := parseAddress(args[0])
+	if err != nil {
+		return err
+	}
+
+	breakpoints[addr] = true
+	cometPrint(fmt.Sprintf("Breakpoint set at #%s", hex(addr, 4)))
+	return nil
+}
+
+func cmdDelete(memory []uint16, state []int, args []string) error {
+	if len(args) < 1 {
+		breakpoints = make(map[int]bool)
+		cometPrint("All breakpoints deleted")
+		return nil
+	}
+	addr, err := parseAddress(args[0])
+	if err != nil {
+		return err
+	}
+	if !breakpoints[addr] {
+		return fmt.Errorf("No breakpoint at #%s", hex(addr, 4))
+	}
+
+	delete(breakpoints, addr)
+	cometPrint(fmt.Sprintf("Breakpoint at #%s deleted", hex(addr, 4)))
+	return nil
+}
+
+func cmdWatch(memory []uint16, state []int, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Usage: watch ADDRESS")
+	}
+	addr, err := parseAddress(args[0])
+	if err != nil {
+		return err
+	}
+
+	watchpoints = append(watchpoints, watchpoint{addr, memGet(memory, addr)})
+	cometPrint(fmt.Sprintf("Watchpoint #%d set at #%s", len(watchpoints), hex(addr, 4)))
+	return nil
+}
+
+// checkWatchpoints reports every watched word that changed since the last check
+func checkWatchpoints(memory []uint16) bool {
+	changed := false
+	for i := range watchpoints {
+		wp := &watchpoints[i]
+		val := memGet(memory, wp.addr)
+		if val != wp.lastVal {
+			cometPrint(fmt.Sprintf("Watchpoint #%d: #%s changed %d -> %d", i+1, hex(wp.addr, 4), wp.lastVal, val))
+			wp.lastVal = val
+			changed = true
+		}
+	}
+	return changed
+}
+
+func cmdInfo(memory []uint16, state []int, args []string) error {
+	topic := "break"
+	if len(args) > 0 {
+		topic = args[0]
+	}
+
+	switch topic {
+	case "b", "break", "breakpoints":
+		if len(breakpoints) == 0 {
+			cometPrint("No breakpoints")
+			return nil
+		}
+		var addrs []int
+		for addr := range breakpoints {
+			addrs = append(addrs, addr)
+		}
+		sort.Ints(addrs)
+		for i, addr := range addrs {
+			cometPrint(fmt.Sprintf("%d: #%s", i+1, hex(addr, 4)))
+		}
+		return nil
+
+	case "w", "watch", "watchpoints":
+		if len(watchpoints) == 0 {
+			cometPrint("No watchpoints")
+			return nil
+		}
+		for i, wp := range watchpoints {
+			cometPrint(fmt.Sprintf("%d: #%s = #%s", i+1, hex(wp.addr, 4), hex(wp.lastVal, 4)))
+		}
+		return nil
+
+	case "stats":
+		printStats()
+		return nil
+
+	case "r", "reg", "registers":
+		cometPrint(fmt.Sprintf("PC=#%s %d", hex(state[comet2.PC], 4), state[comet2.PC]))
+		cometPrint(fmt.Sprintf("FR=#%s %d %s", hex(state[comet2.FR], 4), state[comet2.FR], flagLetters(state[comet2.FR])))
+		cometPrint(fmt.Sprintf("SP=#%s %d", hex(state[comet2.SP], 4), state[comet2.SP]))
+		for i := 0; i < 8; i++ {
+			cometPrint(fmt.Sprintf("GR%d=#%s %d", i, hex(state[comet2.GR0+i], 4), signed(state[comet2.GR0+i])))
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Undefined info topic \"%s\". Try \"help\".", topic)
+}
+
+func cmdSet(memory []uint16, state []int, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("Usage: set REGISTER|ADDRESS VALUE")
+	}
+	val, ok := comet2.ExpandNumber(args[1])
+	if !ok {
+		return fmt.Errorf("Invalid value \"%s\"", args[1])
+	}
+
+	if reg, ok := registerIndex(args[0]); ok {
+		switch reg {
+		case comet2.PC, comet2.SP:
+			// Addresses must not wrap around the 16-bit range
+			addr, err := parseAddress(args[1])
+			if err != nil {
+				return err
+			}
+			val = addr
+		case comet2.FR:
+			if val > comet2.FR_OVER|comet2.FR_MINUS|comet2.FR_ZERO {
+				return fmt.Errorf("Invalid flag value \"%s\": must be 0 to 7", args[1])
+			}
+		}
+		state[reg] = val
+		return nil
+	}
+
+	addr, err := parseAddress(args[0])
+	if err != nil {
+		return err
+	}
+	machine.Write(uint16(addr), uint16(val))
+	return nil
+}
+
+func cmdFill(memory []uint16, state []int, args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("Usage: fill START END VALUE")
+	}
+	start, err := parseAddress(args[0])
+	if err != nil {
+		return err
+	}
+	end, err := parseAddress(args[1])
+	if err != nil {
+		return err
+	}
+	if start > end {
+		return fmt.Errorf("Start address #%s is after end address #%s", hex(start, 4), hex(end, 4))
+	}
+	val, ok := comet2.ExpandNumber(args[2])
+	if !ok {
+		return fmt.Errorf("Invalid value \"%s\"", args[2])
+	}
+
+	for addr := start; addr <= end; addr++ {
+		machine.Write(uint16(addr), uint16(val))
+	}
+	return nil
+}
+
+// Number of matches search prints before only counting the rest
+const SEARCH_MAX_SHOWN = 100
+
+func cmdSearch(memory []uint16, state []int, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Usage: search VALUE[,VALUE...]")
+	}
+	var pattern []uint16
+	for _, arg := range strings.Split(strings.Join(args, ""), ",") {
+		val, ok := comet2.ExpandNumber(arg)
+		if !ok {
+			return fmt.Errorf("Invalid value \"%s\"", arg)
+		}
+		pattern = append(pattern, uint16(val))
+	}
+
+	found := 0
+	for addr := 0; addr+len(pattern) <= len(memory); addr++ {
+		match := true
+		for i, val := range pattern {
+			if memory[addr+i] != val {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		if found < SEARCH_MAX_SHOWN {
+			cometPrint(fmt.Sprintf("#%s%s", hex(addr, 4), sourceLine(addr)))
+		}
+		found++
+	}
+
+	switch {
+	case found == 0:
+		cometPrint("Not found")
+	case found > SEARCH_MAX_SHOWN:
+		cometPrint(fmt.Sprintf("%d matches (first %d shown)", found, SEARCH_MAX_SHOWN))
+	case found == 1:
+		cometPrint("1 match")
+	default:
+		cometPrint(fmt.Sprintf("%d matches", found))
+	}
+	return nil
+}
+
+// registerIndex returns the state index of a register name
+func registerIndex(name string) (int, bool) {
+	name = strings.ToUpper(name)
+	switch name {
+	case "PC":
+		return comet2.PC, true
+	case "SP":
+		return comet2.SP, true
+	case "FR":
+		return comet2.FR, true
+	}
+	if comet2.IsRegister(name) {
+		return comet2.GR0 + int(name[2]-'0'), true
+	}
+	return 0, false
+}
+
+// parseAddress parses a decimal or #hex address within the 64K memory space,
+// or a label of the assembled program
+func parseAddress(arg string) (int, error) {
+	if addr, ok, err := labelAddress(arg); ok || err != nil {
+		return addr, err
+	}
+
+	var addr int64
+	var err error
+	if strings.HasPrefix(arg, "#") {
+		addr, err = strconv.ParseInt(arg[1:], 16, 64)
+	} else {
+		addr, err = strconv.ParseInt(arg, 10, 64)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Invalid register or address \"%s\"", arg)
+	}
+	if addr < 0 || addr >= comet2.MEMORY_SIZE {
+		return 0, fmt.Errorf("Address \"%s\" is out of range", arg)
+	}
+	return int(addr), nil
+}
+
+// labelAddress resolves LABEL or SCOPE:LABEL in the assembled program. A
+// bare label defined in several programs must be qualified, unless one of
+// them is the START label.
+func labelAddress(name string) (int, bool, error) {
+	if comet2asm == nil {
+		return 0, false, nil
+	}
+	addrs := make(map[string]int)
+	for _, sym := range comet2asm.Symbols() {
+		addrs[sym.Scope+":"+sym.Name] = sym.Address
+	}
+	if addr, exists := addrs[name]; exists {
+		return addr, true, nil
+	}
+	if addr, exists := addrs[name+":"+name]; exists {
+		return addr, true, nil
+	}
+
+	var matches []string
+	for key := range addrs {
+		if strings.HasSuffix(key, ":"+name) {
+			matches = append(matches, key)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return 0, false, nil
+	case 1:
+		return addrs[matches[0]], true, nil
+	}
+	sort.Strings(matches)
+	return 0, false, fmt.Errorf("Label \"%s\" is ambiguous: %s", name, strings.Join(matches, ", "))
+}
+
+func printStats() {
+	cometPrint(fmt.Sprintf("Instructions: %d", machine.Instructions))
+	cometPrint(fmt.Sprintf("Cycles:       %d (estimated)", machine.Cycles))
+}
+
+// sourcePos is a line in the source files
+type sourcePos struct {
+	File string
+	Line int
+}
+
+// coverageReport marks every source line holding instructions with + if
+// one of them was executed and - if none was, followed by a summary
+func coverageReport(asmState *comet2.AssemblerState, executed map[int]bool) []string {
+	covered := make(map[sourcePos]bool)
+	sources := make(map[sourcePos]string)
+	for addr := 0; addr < asmState.AddressMax(); addr++ {
+		word, ok := asmState.Word(addr)
+		if !ok || !word.Code {
+			continue
+		}
+		pos := sourcePos{File: word.File, Line: word.Line}
+		covered[pos] = covered[pos] || executed[addr]
+		sources[pos] = word.Source
+	}
+
+	var positions []sourcePos
+	for pos := range covered {
+		positions = append(positions, pos)
+	}
+	// Lines of the main file come first, then each included file
+	sort.Slice(positions, func(i, j int) bool {
+		iMain := positions[i].File == asmState.MainFile()
+		jMain := positions[j].File == asmState.MainFile()
+		if iMain != jMain {
+			return iMain
+		}
+		if positions[i].File != positions[j].File {
+			return positions[i].File < positions[j].File
+		}
+		return positions[i].Line < positions[j].Line
+	})
+
+	report := []string{"COVERAGE"}
+	count := 0
+	for _, pos := range positions {
+		mark := "-"
+		if covered[pos] {
+			mark = "+"
+			count++
+		}
+		where := strconv.Itoa(pos.Line)
+		if pos.File != asmState.MainFile() {
+			where = pos.File + ":" + where
+		}
+		report = append(report, fmt.Sprintf("%4s %s\t%s", where, mark, sources[pos]))
+	}
+	report = append(report, fmt.Sprintf("Executed %d of %d lines", count, len(positions)))
+	return report
+}
+
+// Number of instructions listed by -profile
+const PROFILE_TOP = 10
+
+// profileReport lists the n most executed addresses with their
+// disassembly and source line
+func profileReport(memory []uint16, counts map[int]int, n int) []string {
+	var addrs []int
+	for addr := range counts {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		if counts[addrs[i]] != counts[addrs[j]] {
+			return counts[addrs[i]] > counts[addrs[j]]
+		}
+		return addrs[i] < addrs[j]
+	})
+	if len(addrs) > n {
+		addrs = addrs[:n]
+	}
+
+	report := []string{"PROFILE"}
+	tmp := make([]int, comet2.SP+1)
+	for _, addr := range addrs {
+		tmp[comet2.PC] = addr
+		inst, opr, _ := comet2.Disassemble(memory, tmp)
+		report = append(report, fmt.Sprintf("%8d #%s\t%s\t%s%s", counts[addr], hex(addr, 4), inst, opr, sourceLine(addr)))
+	}
+	return report
+}
+
+func cmdReset(memory []uint16, state []int, args []string) error {
+	resetMachine(memory, state)
+	cometPrint("Program reset")
+	if !*optQuiet {
+		cmdPrint(memory, state, []string{})
+	}
+	return nil
+}
+
+func cmdSave(memory []uint16, state []int, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Usage: save FILE")
+	}
+	if err := writeSnapshot(args[0], memory, state); err != nil {
+		return err
+	}
+	cometPrint(fmt.Sprintf("Machine state saved to %s", args[0]))
+	return nil
+}
+
+func cmdLoad(memory []uint16, state []int, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Usage: load FILE")
+	}
+	if err := readSnapshot(args[0], memory, state); err != nil {
+		return err
+	}
+	stopRun()
+	clearHistory()
+	cometPrint(fmt.Sprintf("Machine state loaded from %s", args[0]))
+	if !*optQuiet {
+		cmdPrint(memory, state, []string{})
+	}
+	return nil
+}
+
+// Number of typed commands kept for history and !N
+const CMD_HISTORY_SIZE = 100
+
+// Typed commands, oldest first; cmdHistoryBase commands have been dropped
+// from the front so that numbers stay the same as the list is trimmed
+var (
+	cmdHistory     []string
+	cmdHistoryBase int
+)
+
+// addHistory records a command typed at the monitor prompt
+func addHistory(cmd string) {
+	cmdHistory = append(cmdHistory, cmd)
+	if len(cmdHistory) > CMD_HISTORY_SIZE {
+		cmdHistory = cmdHistory[1:]
+		cmdHistoryBase++
+	}
+}
+
+// recallCommand returns command number arg from the history
+func recallCommand(arg string) (string, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		return "", fmt.Errorf("Usage: !N")
+	}
+	idx := n - cmdHistoryBase - 1
+	if idx < 0 || idx >= len(cmdHistory) {
+		return "", fmt.Errorf("No command %d in history", n)
+	}
+	return cmdHistory[idx], nil
+}
+
+func cmdHistoryList(memory []uint16, state []int, args []string) error {
+	for i, cmd := range cmdHistory {
+		cometPrint(fmt.Sprintf("%5d  %s", cmdHistoryBase+i+1, cmd))
+	}
 	return nil
 }
 
 func cmdHelp(memory []uint16, state []int, args []string) error {
 	cometPrint("List of commands:")
-	cometPrint("r,  run             \t\tStart execution of program.")
+	cometPrint("r,  run             \t\tRun from the current PC until a breakpoint or the end of program.")
+	cometPrint("c,  continue        \t\tSame as run, which resumes where execution stopped.")
 	cometPrint("s,  step  [N]       \t\tStep execution. Argument N means do this N times.")
+	cometPrint("n,  next            \t\tStep over CALLs; otherwise the same as step.")
+	cometPrint("rs, back  [N]       \t\tUndo the last N executed instructions (up to 1000).")
+	cometPrint("finish, stepout     \t\tRun until the current subroutine returns.")
 	cometPrint("p,  print           \t\tPrint status of PC/FR/SP/GR0..GR7 registers.")
-	cometPrint("du, dump [ADDRESS]  \t\tDump 128 words of memory image from specified ADDRESS.")
-	cometPrint("st, stack           \t\tDump 128 words of stack image.")
-	cometPrint("di, disasm [ADDRESS]\t\tDisassemble 32 words from specified ADDRESS.")
+	cometPrint("du, dump [ADDRESS [N]]\tDump N (default 128) words of memory image from ADDRESS.")
+	cometPrint("st, stack           \t\tList up to 128 words of the stack, from SP to the bottom.")
+	cometPrint("bt, backtrace       \t\tList the CALLs leading to the current PC.")
+	cometPrint("di, disasm [ADDRESS [N]]\tDisassemble N (default 16) instructions from ADDRESS.")
+	cometPrint("x,  examine ADDRESS|REGISTER\tShow the word at ADDRESS (or at PC, SP, GRn) as hex, decimal and instruction.")
+	cometPrint("goto ADDRESS        \t\tRun until PC reaches ADDRESS.")
+	cometPrint("b,  break ADDRESS   \t\tSet a breakpoint at ADDRESS (decimal, #hex or label).")
+	cometPrint("d,  delete [ADDRESS]\t\tDelete the breakpoint at ADDRESS, or all breakpoints.")
+	cometPrint("i,  info [break]    \t\tList breakpoints.")
+	cometPrint("watch ADDRESS       \t\tStop execution when the word at ADDRESS changes.")
+	cometPrint("i,  info watch      \t\tList watchpoints.")
+	cometPrint("i,  info stats      \t\tPrint executed instruction count and estimated cycles.")
+	cometPrint("i,  info registers  \t\tPrint registers as NAME=#HEX DECIMAL, one per line.")
+	cometPrint("set TARGET VALUE    \t\tSet register (GR0..GR7, PC, SP, FR) or memory ADDRESS to VALUE.")
+	cometPrint("fill START END VALUE\t\tSet every word from START to END to VALUE.")
+	cometPrint("search VALUE[,VALUE...]\tList addresses holding VALUE, or the sequence of values.")
+	cometPrint("reset               \t\tRestart the program from its initial state.")
+	cometPrint("save FILE           \t\tSave memory, registers and breakpoints to FILE.")
+	cometPrint("load FILE           \t\tRestore a machine state saved with save.")
+	cometPrint("format [hex|dec|bin|char]\tChoose how print shows register values.")
+	cometPrint("history             \t\tList the commands typed so far; !N runs command N again.")
 	cometPrint("h,  help            \t\tPrint list of commands.")
 	cometPrint("q,  quit            \t\tExit comet2.")
 
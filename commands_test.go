@@ -0,0 +1,476 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/f0reachARR/casljs/comet2"
+)
+
+// assembleSource writes source to a temporary file and assembles it
+func assembleSource(t *testing.T, source string) ([]uint16, uint16, *comet2.AssemblerState, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.cas")
+	if err := os.WriteFile(path, []byte(source), 0644); err != nil {
+		t.Fatalf("Failed to write source: %v", err)
+	}
+	asmState := comet2.NewAssemblerState()
+	bin, start, err := comet2.AssembleFile(path, asmState)
+	return bin, start, asmState, err
+}
+
+// setFlag overrides a boolean command line option for the duration of a test
+func setFlag(t *testing.T, opt *bool, val bool) {
+	t.Helper()
+	orig := *opt
+	*opt = val
+	t.Cleanup(func() { *opt = orig })
+}
+
+// captureOutput returns everything written to stdout while f runs
+func captureOutput(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	orig := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = orig }()
+
+	done := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		done <- string(data)
+	}()
+
+	f()
+	w.Close()
+	return <-done
+}
+
+// newTestMachine loads image into the monitor's machine and returns its
+// memory and registers
+func newTestMachine(image []uint16) ([]uint16, []int) {
+	loadMachine(image, 0)
+	return comet2mem, state
+}
+
+func TestSetRegister(t *testing.T) {
+	setFlag(t, optNoColor, true)
+	memory, state := newTestMachine(nil)
+
+	if err := executeCommand("set", []string{"GR0", "#00FF"}, memory, state); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	output := captureOutput(t, func() {
+		executeCommand("print", nil, memory, state)
+	})
+	if !strings.Contains(output, "GR0 #00ff(   255)") {
+		t.Errorf("GR0 not updated:\n%s", output)
+	}
+
+	if err := executeCommand("set", []string{"GR9", "1"}, memory, state); err == nil {
+		t.Errorf("Expected error for unknown register")
+	}
+	if err := executeCommand("set", []string{"#10000", "1"}, memory, state); err == nil {
+		t.Errorf("Expected error for out of range address")
+	}
+}
+
+func TestSetMemory(t *testing.T) {
+	memory, state := newTestMachine(nil)
+
+	if err := executeCommand("set", []string{"#1234", "42"}, memory, state); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	output := captureOutput(t, func() {
+		executeCommand("dump", []string{"#1234"}, memory, state)
+	})
+	if !strings.HasPrefix(output, "1234: 002a 0000") {
+		t.Errorf("Memory not updated:\n%s", output)
+	}
+}
+
+func TestFill(t *testing.T) {
+	memory, state := newTestMachine(nil)
+
+	if err := executeCommand("fill", []string{"#0011", "#0013", "#DEAD"}, memory, state); err != nil {
+		t.Fatalf("fill failed: %v", err)
+	}
+	output := captureOutput(t, func() {
+		executeCommand("dump", []string{"#0010"}, memory, state)
+	})
+	if !strings.HasPrefix(output, "0010: 0000 dead dead dead 0000") {
+		t.Errorf("Memory not filled:\n%s", output)
+	}
+
+	if err := executeCommand("fill", []string{"#0013", "#0011", "0"}, memory, state); err == nil {
+		t.Errorf("Expected error for reversed range")
+	}
+	if err := executeCommand("fill", []string{"0", "#10000", "0"}, memory, state); err == nil {
+		t.Errorf("Expected error for out of range address")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	memory, state := newTestMachine(nil)
+	memory[0x1234] = 0xbeef
+	memory[0x2000] = 0xbeef
+	memory[0x2001] = 7
+
+	output := captureOutput(t, func() {
+		executeCommand("search", []string{"#BEEF"}, memory, state)
+	})
+	if output != "#1234\n#2000\n2 matches\n" {
+		t.Errorf("search #BEEF =\n%s", output)
+	}
+
+	output = captureOutput(t, func() {
+		executeCommand("search", []string{"#beef,7"}, memory, state)
+	})
+	if output != "#2000\n1 match\n" {
+		t.Errorf("search #beef,7 =\n%s", output)
+	}
+
+	output = captureOutput(t, func() {
+		executeCommand("search", []string{"12345"}, memory, state)
+	})
+	if output != "Not found\n" {
+		t.Errorf("search 12345 =\n%s", output)
+	}
+}
+
+func TestDumpDisasmCount(t *testing.T) {
+	setFlag(t, optNoColor, true)
+	memory, state := newTestMachine(nil)
+
+	countLines := func(args ...string) int {
+		output := captureOutput(t, func() {
+			if err := executeCommand(args[0], args[1:], memory, state); err != nil {
+				t.Errorf("%v failed: %v", args, err)
+			}
+		})
+		return strings.Count(output, "\n")
+	}
+
+	cases := []struct {
+		args []string
+		want int
+	}{
+		{[]string{"dump", "0"}, 16},
+		{[]string{"dump", "0", "20"}, 3},
+		{[]string{"dump", "#FFF8", "100"}, 1},
+		{[]string{"disasm", "0"}, 16},
+		{[]string{"disasm", "0", "5"}, 5},
+		{[]string{"disasm", "#FFFE", "10"}, 2},
+	}
+	for _, c := range cases {
+		if got := countLines(c.args...); got != c.want {
+			t.Errorf("%v printed %d lines, want %d", c.args, got, c.want)
+		}
+	}
+
+	// A partial row keeps the character column aligned
+	output := captureOutput(t, func() {
+		executeCommand("dump", []string{"0", "2"}, memory, state)
+	})
+	if output != "0000: 0000 0000"+strings.Repeat(" ", 31)+"..\n" {
+		t.Errorf("dump 0 2 = %q", output)
+	}
+
+	if err := executeCommand("dump", []string{"0", "0"}, memory, state); err == nil {
+		t.Errorf("Expected error for zero count")
+	}
+}
+
+func TestFormat(t *testing.T) {
+	setFlag(t, optNoColor, true)
+	t.Cleanup(func() { displayFormat = "hex" })
+	memory, state := newTestMachine(nil)
+	state[comet2.GR1] = 0x00a5
+
+	if err := executeCommand("format", []string{"bin"}, memory, state); err != nil {
+		t.Fatalf("format failed: %v", err)
+	}
+	output := captureOutput(t, func() {
+		executeCommand("print", nil, memory, state)
+	})
+	if !strings.Contains(output, "GR1 0000000010100101") {
+		t.Errorf("GR1 not shown in binary:\n%s", output)
+	}
+
+	executeCommand("format", []string{"char"}, memory, state)
+	state[comet2.GR2] = 'A'
+	output = captureOutput(t, func() {
+		executeCommand("print", nil, memory, state)
+	})
+	if !strings.Contains(output, "GR2 'A'") || !strings.Contains(output, "GR0 '.'") {
+		t.Errorf("Registers not shown as characters:\n%s", output)
+	}
+
+	if err := executeCommand("format", []string{"oct"}, memory, state); err == nil {
+		t.Errorf("Expected error for unknown format")
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	setFlag(t, optQuiet, true)
+	orig := breakpoints
+	t.Cleanup(func() { breakpoints = orig })
+	breakpoints = map[int]bool{4: true}
+
+	bin, _, _, err := assembleSource(t, straightLineProgram)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	memory, state := newTestMachine(bin)
+	captureOutput(t, func() {
+		executeCommand("step", nil, memory, state)
+		executeCommand("step", nil, memory, state)
+		memory[0x100] = 0xbeef
+	})
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	captureOutput(t, func() {
+		if err := executeCommand("save", []string{path}, memory, state); err != nil {
+			t.Fatalf("save failed: %v", err)
+		}
+	})
+
+	breakpoints = map[int]bool{}
+	loadedMemory, loadedState := newTestMachine(nil)
+	captureOutput(t, func() {
+		if err := executeCommand("load", []string{path}, loadedMemory, loadedState); err != nil {
+			t.Fatalf("load failed: %v", err)
+		}
+	})
+
+	if !reflect.DeepEqual(loadedState, state) {
+		t.Errorf("state = %v, want %v", loadedState, state)
+	}
+	if !reflect.DeepEqual(loadedMemory, memory) {
+		t.Errorf("Memory differs after load")
+	}
+	if machine.Instructions != 2 || !breakpoints[4] {
+		t.Errorf("Instructions = %d, breakpoints = %v, want 2 and [4]", machine.Instructions, breakpoints)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"format":"other"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := executeCommand("load", []string{path}, loadedMemory, loadedState); err == nil {
+		t.Errorf("Expected error for a foreign file")
+	}
+}
+
+func TestContinueFromBreakpoint(t *testing.T) {
+	setFlag(t, optNoColor, true)
+	orig := breakpoints
+	t.Cleanup(func() { breakpoints = orig })
+	breakpoints = map[int]bool{2: true, 4: true}
+
+	bin, _, _, err := assembleSource(t, straightLineProgram)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	memory, state := newTestMachine(bin)
+	captureOutput(t, func() {
+		if err := executeCommand("run", nil, memory, state); err != nil {
+			t.Fatalf("run failed: %v", err)
+		}
+	})
+	if state[comet2.PC] != 2 {
+		t.Fatalf("PC = #%s, want #0002", hex(state[comet2.PC], 4))
+	}
+
+	// continue leaves the breakpoint it stopped at and says nothing until
+	// the next one
+	output := captureOutput(t, func() {
+		if err := executeCommand("continue", nil, memory, state); err != nil {
+			t.Fatalf("continue failed: %v", err)
+		}
+	})
+	if !strings.HasPrefix(output, "Breakpoint at #0004\n") {
+		t.Errorf("output = %q, want it to start with the breakpoint", output)
+	}
+	if state[comet2.PC] != 4 || state[comet2.GR2] != 2 || state[comet2.GR3] != 0 {
+		t.Errorf("PC, GR2, GR3 = #%s, %d, %d, want #0004, 2, 0",
+			hex(state[comet2.PC], 4), state[comet2.GR2], state[comet2.GR3])
+	}
+}
+
+func TestInfoRegisters(t *testing.T) {
+	memory, state := newTestMachine(nil)
+	state[comet2.GR0] = 0xfffe
+	state[comet2.FR] = comet2.FR_MINUS
+
+	output := captureOutput(t, func() {
+		if err := executeCommand("info", []string{"registers"}, memory, state); err != nil {
+			t.Fatalf("info registers failed: %v", err)
+		}
+	})
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 11 {
+		t.Fatalf("Got %d lines, want 11:\n%s", len(lines), output)
+	}
+	if lines[1] != "FR=#0002 2 -S-" {
+		t.Errorf("FR line = %q, want %q", lines[1], "FR=#0002 2 -S-")
+	}
+	if lines[3] != "GR0=#fffe -2" {
+		t.Errorf("GR0 line = %q, want %q", lines[3], "GR0=#fffe -2")
+	}
+}
+
+func TestStepBack(t *testing.T) {
+	setFlag(t, optQuiet, true)
+	src := `MAIN	START
+	LAD	GR1, 5
+	ST	GR1, DATA
+	PUSH	3
+	ADDA	GR1, DATA
+	RET
+DATA	DC	7
+	END
+`
+	bin, _, _, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	memory, state := newTestMachine(bin)
+	clearHistory()
+
+	if err := executeCommand("step", []string{"1"}, memory, state); err != nil {
+		t.Fatalf("step failed: %v", err)
+	}
+	wantMemory := append([]uint16(nil), memory...)
+	wantState := append([]int(nil), state...)
+
+	for i := 0; i < 3; i++ {
+		if err := executeCommand("step", nil, memory, state); err != nil {
+			t.Fatalf("step failed: %v", err)
+		}
+	}
+	if memGet(memory, 0x09) != 5 || state[comet2.GR1] != 10 || state[comet2.SP] != comet2.STACK_TOP-1 {
+		t.Fatalf("DATA, GR1, SP = %d, %d, #%s after stepping", memGet(memory, 0x09), state[comet2.GR1], hex(state[comet2.SP], 4))
+	}
+
+	if err := executeCommand("back", []string{"3"}, memory, state); err != nil {
+		t.Fatalf("back failed: %v", err)
+	}
+	if !reflect.DeepEqual(state, wantState) {
+		t.Errorf("state = %v, want %v", state, wantState)
+	}
+	if !reflect.DeepEqual(memory, wantMemory) {
+		t.Errorf("DATA = %d, stack top = %d after back", memGet(memory, 0x09), memGet(memory, comet2.STACK_TOP-1))
+	}
+
+	if err := executeCommand("rs", nil, memory, state); err != nil || state[comet2.PC] != 0 {
+		t.Errorf("rs = %v with PC #%s, want PC #0000", err, hex(state[comet2.PC], 4))
+	}
+	if err := executeCommand("rs", nil, memory, state); err == nil {
+		t.Errorf("Expected error with no history")
+	}
+}
+
+func TestSetPCSPFR(t *testing.T) {
+	setFlag(t, optNoColor, true)
+	image := make([]uint16, 0x12)
+	image[0x10], image[0x11] = 0x1210, 0x0005 // LAD GR1, 5
+	memory, state := newTestMachine(image)
+
+	for _, args := range [][]string{{"PC", "#0010"}, {"sp", "#FE00"}, {"FR", "4"}} {
+		if err := executeCommand("set", args, memory, state); err != nil {
+			t.Fatalf("set %v failed: %v", args, err)
+		}
+	}
+	output := captureOutput(t, func() {
+		executeCommand("print", nil, memory, state)
+		executeCommand("x", []string{"PC"}, memory, state)
+	})
+	for _, want := range []string{"PR  #0010 [ LAD", "SP  #fe00", "FR    100(     4)", "#0010: #1210 4624\tLAD\tGR1,   #0005\n"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("%q missing from output:\n%s", want, output)
+		}
+	}
+
+	for _, args := range [][]string{{"PC", "#10000"}, {"SP", "-1"}, {"FR", "8"}} {
+		if err := executeCommand("set", args, memory, state); err == nil {
+			t.Errorf("set %v: expected an out of range error", args)
+		}
+	}
+	if state[comet2.PC] != 0x10 || state[comet2.SP] != 0xfe00 || state[comet2.FR] != comet2.FR_OVER {
+		t.Errorf("PC, SP, FR = #%s, #%s, %d, want unchanged", hex(state[comet2.PC], 4), hex(state[comet2.SP], 4), state[comet2.FR])
+	}
+}
+
+func TestPrintFlags(t *testing.T) {
+	setFlag(t, optNoColor, true)
+	memory, state := newTestMachine(nil)
+	state[comet2.FR] = comet2.FR_OVER | comet2.FR_MINUS
+
+	output := captureOutput(t, func() {
+		executeCommand("print", nil, memory, state)
+	})
+	for _, want := range []string{"FR    110(     6)[ OS- ]\n", "FR = OF=1 SF=1 ZF=0\n"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("%q missing from output:\n%s", want, output)
+		}
+	}
+}
+
+func TestStackDump(t *testing.T) {
+	// PUSH 5 / PUSH -2
+	memory, state := newTestMachine([]uint16{0x7000, 0x0005, 0x7000, 0xfffe})
+
+	output := captureOutput(t, func() {
+		executeCommand("stack", nil, memory, state)
+	})
+	if output != "Stack is empty (SP = #ff00)\n" {
+		t.Errorf("Empty stack output = %q", output)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := stepExec(); err != nil {
+			t.Fatalf("stepExec failed: %v", err)
+		}
+	}
+	output = captureOutput(t, func() {
+		executeCommand("stack", nil, memory, state)
+	})
+	want := "Stack from SP #fefe to #ff00 (2 words)\n" +
+		"SP -> #fefe: #fffe     -2\n" +
+		"      #feff: #0005      5\n"
+	if output != want {
+		t.Errorf("stack output = %q, want %q", output, want)
+	}
+}
+
+func TestMachineOut(t *testing.T) {
+	src := `MAIN	START
+	OUT	MSG, LEN
+	RET
+MSG	DC	'Hi'
+LEN	DC	2
+	END
+`
+	bin, _, _, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	newTestMachine(bin)
+	var got []string
+	machine.Out = func(msg string) { got = append(got, msg) }
+	for {
+		if _, err := stepExec(); err != nil {
+			break
+		}
+	}
+	if len(got) != 1 || got[0] != "Hi" {
+		t.Errorf("output = %q, want [\"Hi\"]", got)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/f0reachARR/casljs/comet2"
+)
+
+// AssemblyJSON is the machine-readable assembly result printed by -json
+type AssemblyJSON struct {
+	Start   int             `json:"start"`
+	Symbols []comet2.Symbol `json:"symbols"`
+	Words   []WordJSON      `json:"words"`
+}
+
+// WordJSON is an assembled word with the source line that produced it
+type WordJSON struct {
+	Address int    `json:"address"`
+	Value   int    `json:"value"`
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Source  string `json:"source"`
+}
+
+// assemblyJSON encodes the assembled image and symbol table as JSON
+func assemblyJSON(asmState *comet2.AssemblerState, image []uint16, startAddress uint16) ([]byte, error) {
+	result := AssemblyJSON{
+		Start:   int(startAddress),
+		Symbols: asmState.Symbols(),
+		Words:   []WordJSON{},
+	}
+
+	for address, val := range image {
+		word := WordJSON{Address: address, Value: int(val)}
+		if origin, ok := asmState.Word(address); ok {
+			word.File = origin.File
+			word.Line = origin.Line
+			word.Source = strings.TrimRight(origin.Source, "\t")
+		}
+		result.Words = append(result.Words, word)
+	}
+
+	return json.MarshalIndent(result, "", "  ")
+}
+
+// Diagnostic is an assembly error or warning printed by -diagnostics
+type Diagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// diagnosticsJSON encodes errs, the errors of the assembly, followed by a
+// warning for every label that is never referenced
+func diagnosticsJSON(asmState *comet2.AssemblerState, errs []error) ([]byte, error) {
+	diags := []Diagnostic{}
+	for _, err := range errs {
+		diag := Diagnostic{File: asmState.MainFile(), Severity: "error", Message: err.Error()}
+		var asmErr *comet2.AsmError
+		if errors.As(err, &asmErr) {
+			diag.File = asmErr.File
+			diag.Line = asmErr.Line
+			diag.Column = asmErr.Column
+			diag.Message = asmErr.Msg
+		}
+		diags = append(diags, diag)
+	}
+	for _, l := range asmState.UnusedLabels() {
+		diags = append(diags, Diagnostic{
+			File:     l.File,
+			Line:     l.Line,
+			Column:   1,
+			Severity: "warning",
+			Message:  fmt.Sprintf("Label '%s' is never referenced", l.Label),
+		})
+	}
+
+	return json.MarshalIndent(diags, "", "  ")
+}
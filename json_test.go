@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAssemblyJSON(t *testing.T) {
+	src := `MAIN	START	BEGIN
+DATA	DC	5
+BEGIN	LD	GR1, DATA
+	RET
+	END
+`
+	bin, start, asmState, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	data, err := assemblyJSON(asmState, bin, start)
+	if err != nil {
+		t.Fatalf("assemblyJSON failed: %v", err)
+	}
+
+	var result AssemblyJSON
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if result.Start != 1 {
+		t.Errorf("start = %d, want 1", result.Start)
+	}
+	found := false
+	for _, sym := range result.Symbols {
+		if sym.Name == "DATA" {
+			found = true
+			if sym.Scope != "MAIN" || sym.Address != 0 || sym.Line != 2 {
+				t.Errorf("DATA = %+v, want MAIN scope at #0000 line 2", sym)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Symbol DATA missing from %+v", result.Symbols)
+	}
+	if len(result.Words) != len(bin) {
+		t.Fatalf("len(words) = %d, want %d", len(result.Words), len(bin))
+	}
+	if w := result.Words[1]; w.Value != 0x1010 || w.Line != 3 || !strings.Contains(w.Source, "LD") {
+		t.Errorf("words[1] = %+v, want LD on line 3", w)
+	}
+}
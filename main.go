@@ -2,56 +2,22 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
-)
-
-const VERSION = "1.0.4 KIT (Jan 23, 2025) - Go Edition"
 
-// System call addresses
-const (
-	SYS_IN   = 0xfff0
-	SYS_OUT  = 0xfff2
-	EXIT_USR = 0x0000
-	EXIT_OVF = 0x0001
-	EXIT_DVZ = 0x0002
-	EXIT_ROV = 0x0003
-)
-
-// Flag register bits
-const (
-	FR_PLUS  = 0
-	FR_ZERO  = 1
-	FR_MINUS = 2
-	FR_OVER  = 4
+	"github.com/f0reachARR/casljs/comet2"
 )
 
-// Stack configuration
-const STACK_TOP = 0xff00
+const VERSION = "1.0.4 KIT (Jan 23, 2025) - Go Edition"
 
-// Register indices
-const (
-	PC = iota
-	FR
-	GR0
-	GR1
-	GR2
-	GR3
-	GR4
-	GR5
-	GR6
-	GR7
-	SP
-)
-
-// Value limits
-const (
-	MAX_SIGNED = 32767
-	MIN_SIGNED = -32768
-)
+// Name of the source read from standard input
+const STDIN_NAME = "<stdin>"
 
 // Input modes
 const (
@@ -67,132 +33,86 @@ var (
 	optNoColor  = flag.Bool("n", false, "[casl2/comet2] disable color messages")
 	optQuiet    = flag.Bool("q", false, "[casl2/comet2] be quiet")
 	optQuietRun = flag.Bool("Q", false, "[comet2] be QUIET! (implies -q and -r)")
+	optNoBanner = flag.Bool("no-banner", false, "[casl2/comet2] hide the banners but keep other messages")
 	optVersion  = flag.Bool("V", false, "output the version number")
+	optObject   = flag.String("o", "", "[casl2] write object file")
+	optLink     = flag.Bool("link", false, "[casl2] assemble every file before \"--\" as one program; inputs follow \"--\"")
+	optLoad     = flag.String("l", "", "[comet2] load object file instead of assembling")
+	optStdin    = flag.Bool("stdin", false, "[casl2] read the source from stdin; every argument is an input (same as file \"-\")")
+	optInput    = flag.String("i", "", "[comet2] read IN inputs from file, one per line")
+	optOutput   = flag.String("O", "", "[comet2] write OUT output to file")
+	optWarn     = flag.Bool("w", false, "[casl2] warn about labels that are never referenced")
+	optFirstErr = flag.Bool("firsterror", false, "[casl2] stop at the first assembly error")
+	optLenient  = flag.Bool("lenient", false, "[casl2] read text after the operands as a comment even without ';'")
+	optMap      = flag.String("m", "", "[casl2] write symbol map file")
+	optListing  = flag.String("L", "", "[casl2] write the -a listing to file")
+	optJSON     = flag.Bool("json", false, "[casl2] print the assembly result as JSON")
+	optBin      = flag.Bool("b", false, "[casl2] print the assembled words in hex (also --bin)")
+	optDiag     = flag.Bool("diagnostics", false, "[casl2] print every assembly error and warning as JSON")
+	optStack    = flag.String("stack", "", "[comet2] initial SP and stack ceiling (default #ff00)")
+	optStkWarn  = flag.Int("stackwarn", 0, "[comet2] warn when the stack comes within N words of the program (0 means off)")
+	optInLen    = flag.Int("inlen", 256, "[comet2] maximum number of characters read by IN")
+	optProfile  = flag.Bool("profile", false, "[comet2] report the most executed instructions")
+	optEOFEmpty = flag.Bool("eofempty", false, "[comet2] read an empty line for IN at end of input instead of stopping")
+	optDivCont  = flag.Bool("divcontinue", false, "[comet2] set ZF and OF on division by zero and continue instead of stopping")
+	optTrapOv   = flag.Bool("trapov", false, "[comet2] stop at instructions that set the overflow flag")
+	optStrict   = flag.Bool("strict", false, "[comet2] stop at words that are not valid instructions")
+	optCov      = flag.Bool("cov", false, "[comet2] report source lines that were never executed")
+	optJumpChk  = flag.Bool("jumpcheck", false, "[comet2] warn when PC lands in the middle of a two-word instruction")
+	optSanitize = flag.Bool("sanitize", false, "[comet2] warn when a word reserved by DS is read before it is written")
+	optSteps    = flag.Int("steps", 0, "[comet2] stop running after N instructions (0 means unlimited)")
 )
 
 // Global variables
 var (
+	machine            *comet2.Machine
 	comet2mem          []uint16
 	comet2startAddress uint16
+	comet2asm          *comet2.AssemblerState
+	initialInputs      []string
 	state              []int
 	inputMode          int
 	inputBuffer        []string
 	lastCmd            string
 	nextCmd            string
-	addressMax         int
-)
-
-// Instruction table for CASL2
-type InstructionType string
-
-const (
-	OP1   InstructionType = "op1"
-	OP2   InstructionType = "op2"
-	OP3   InstructionType = "op3"
-	OP4   InstructionType = "op4"
-	OP5   InstructionType = "op5"
-	START InstructionType = "start"
-	END   InstructionType = "end"
-	DS    InstructionType = "ds"
-	DC    InstructionType = "dc"
-	IN    InstructionType = "in"
-	OUT   InstructionType = "out"
-	RPUSH InstructionType = "rpush"
-	RPOP  InstructionType = "rpop"
+	breakpoints        = make(map[int]bool)
+	breakpointStop     = -1
+	runTarget          = -1
+	runTargetSP        int
+	finishSP           = -1
+	exitStatus         int
+	coverage           map[int]bool
+	profile            map[int]int
+	operandWords       map[int]bool
+	watchpoints        []watchpoint
+	runStepCount       int
+	displayFormat      = "hex"
+	outFile            *os.File
+	outWriter          *bufio.Writer
+	// inputSource performs the monitor's IN, as machine.Out does its OUT;
+	// front ends other than the CLI can replace them to redirect program I/O
+	inputSource comet2.InputFunc = cometIn
+	stdin       *bufio.Scanner
+	stdinEOF    bool
+	sourceStdin bool
 )
 
-type Instruction struct {
-	Code uint8
-	Type InstructionType
-}
-
-var CASL2TBL = map[string]Instruction{
-	"NOP":   {0x00, OP4},
-	"LD":    {0x10, OP5},
-	"ST":    {0x11, OP1},
-	"LAD":   {0x12, OP1},
-	"ADDA":  {0x20, OP5},
-	"SUBA":  {0x21, OP5},
-	"ADDL":  {0x22, OP5},
-	"SUBL":  {0x23, OP5},
-	"MULA":  {0x28, OP5},
-	"DIVA":  {0x29, OP5},
-	"MULL":  {0x2A, OP5},
-	"DIVL":  {0x2B, OP5},
-	"AND":   {0x30, OP5},
-	"OR":    {0x31, OP5},
-	"XOR":   {0x32, OP5},
-	"CPA":   {0x40, OP5},
-	"CPL":   {0x41, OP5},
-	"SLA":   {0x50, OP1},
-	"SRA":   {0x51, OP1},
-	"SLL":   {0x52, OP1},
-	"SRL":   {0x53, OP1},
-	"JMI":   {0x61, OP2},
-	"JNZ":   {0x62, OP2},
-	"JZE":   {0x63, OP2},
-	"JUMP":  {0x64, OP2},
-	"JPL":   {0x65, OP2},
-	"JOV":   {0x66, OP2},
-	"PUSH":  {0x70, OP2},
-	"POP":   {0x71, OP3},
-	"CALL":  {0x80, OP2},
-	"RET":   {0x81, OP4},
-	"SVC":   {0xf0, OP2},
-	"START": {0x00, START},
-	"END":   {0x00, END},
-	"DS":    {0x00, DS},
-	"DC":    {0x00, DC},
-	"IN":    {0x00, IN},
-	"OUT":   {0x00, OUT},
-	"RPUSH": {0x00, RPUSH},
-	"RPOP":  {0x00, RPOP},
-}
-
-// Symbol table entry
-type SymbolEntry struct {
-	Val  interface{}
-	File string
-	Line int
-}
-
-type MemoryEntry struct {
-	Val  interface{}
-	File string
-	Line int
-}
-
-// Assembler state
-type AssemblerState struct {
-	symtbl         map[string]*SymbolEntry
-	memory         map[int]*MemoryEntry
-	buf            []string
-	outdump        []string
-	actualLabel    string
-	virtualLabel   string
-	firstStart     bool
-	varScope       string
-	literalCounter int
-	file           string
-	line           int
-}
-
-func newAssemblerState() *AssemblerState {
-	return &AssemblerState{
-		symtbl:     make(map[string]*SymbolEntry),
-		memory:     make(map[int]*MemoryEntry),
-		buf:        make([]string, 0),
-		outdump:    make([]string, 0),
-		firstStart: true,
-	}
+// Memory word watched for changes
+type watchpoint struct {
+	addr    int
+	lastVal int
 }
 
 func main() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: c2c2 [options] <casl2file> [input1 ...]\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: c2c2 [options] <casl2file> [input1 ...]\n")
+		fmt.Fprintf(os.Stderr, "       c2c2 [options] -link <casl2file> ... [-- input1 ...]\n")
+		fmt.Fprintf(os.Stderr, "       c2c2 [options] -l <objfile> [input1 ...]\n")
+		fmt.Fprintf(os.Stderr, "       c2c2 [options] --stdin [input1 ...] < <casl2file>\n\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 	}
+	flag.BoolVar(optBin, "bin", false, "[casl2] same as -b")
 	flag.Parse()
 
 	if *optVersion {
@@ -205,52 +125,235 @@ func main() {
 		*optRun = true
 	}
 
-	args := flag.Args()
-	if len(args) < 1 {
-		fmt.Fprintln(os.Stderr, "[CASL2 ERROR] No casl2 source file is specified.")
-		os.Exit(1)
+	// The listing file needs the -a listing to be collected
+	if *optListing != "" {
+		*optAll = true
 	}
 
-	inputFilepath := args[0]
-	inputBuffer = args[1:]
+	// JSON and -b replace the banners and the listing
+	if *optJSON || *optDiag || *optBin {
+		*optQuiet = true
+		*optAll = false
+	}
 
-	if !*optQuiet {
-		printGreen(`   _________   _____ __       ________
+	args := flag.Args()
+	var comet2bin []uint16
+
+	if *optLoad != "" {
+		// Run a pre-assembled object file; every argument is an input
+		image, startAddress, err := readObject(*optLoad)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		comet2bin = image
+		comet2startAddress = startAddress
+		inputBuffer = args
+	} else {
+		if *optStdin {
+			args = append([]string{"-"}, args...)
+		}
+		if len(args) < 1 {
+			fmt.Fprintln(os.Stderr, "[CASL2 ERROR] No casl2 source file is specified.")
+			os.Exit(1)
+		}
+
+		inputFilepath := args[0]
+		inputBuffer = args[1:]
+		sourceStdin = inputFilepath == "-"
+		var linkFiles []string
+		if *optLink {
+			// Sources run up to "--"; only the arguments after it are inputs
+			linkFiles, inputBuffer = args[1:], nil
+			for i, arg := range args {
+				if arg == "--" {
+					linkFiles, inputBuffer = args[1:i], args[i+1:]
+					break
+				}
+			}
+			if inputFilepath == "--" {
+				fmt.Fprintln(os.Stderr, "[CASL2 ERROR] No casl2 source file is specified.")
+				os.Exit(1)
+			}
+		}
+
+		if !*optQuiet && !*optNoBanner {
+			printGreen(`   _________   _____ __       ________
   / ____/   | / ___// /      /  _/  _/
  / /   / /| | \__ \/ /       / / / /  
 / /___/ ___ |___/ / /___   _/ /_/ /   
 \____/_/  |_/____/_____/  /___/___/   `)
-		fmt.Printf("This is CASL II, version %s.\n(c) 2001-2023, Osamu Mizuno.\n\n", VERSION)
+			fmt.Printf("This is CASL II, version %s.\n(c) 2001-2023, Osamu Mizuno.\n\n", VERSION)
+		}
+
+		// Assemble the code
+		asmState := comet2.NewAssemblerState()
+		asmState.LinkFiles = linkFiles
+		asmState.KeepGoing = *optDiag || !*optFirstErr
+		asmState.Lenient = *optLenient
+		asmState.Listing = *optAll
+		bin, startAddress, err := assembleInput(inputFilepath, asmState)
+
+		if *optDiag {
+			// Errors such as an unreadable file stop before any line is seen
+			errs := asmState.Errors()
+			if err != nil && len(errs) == 0 {
+				errs = []error{&comet2.AsmError{File: inputFilepath, Msg: err.Error()}}
+			}
+			data, jsonErr := diagnosticsJSON(asmState, errs)
+			if jsonErr != nil {
+				fmt.Fprintln(os.Stderr, jsonErr)
+				os.Exit(1)
+			}
+			fmt.Println(string(data))
+			if err != nil {
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+
+		if err != nil {
+			printAsmError(err)
+			os.Exit(1)
+		}
+		comet2bin = bin
+		comet2asm = asmState
+
+		// -L sends the listing to a file instead of stdout
+		if *optAll && *optListing == "" {
+			caslPrint("CASL LISTING\n")
+			for _, line := range asmState.ListingLines() {
+				caslPrint(line)
+			}
+		}
+
+		if *optWarn {
+			for _, l := range asmState.UnusedLabels() {
+				fmt.Fprintln(os.Stderr, colorYellow(fmt.Sprintf("Warning: label '%s' defined at line %d is never referenced", l.Label, l.Line)))
+			}
+		}
+
+		caslPrint("Successfully assembled.")
+
+		comet2startAddress = startAddress
+
+		if *optMap != "" {
+			if err := writeSymbolMap(*optMap, asmState); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+
+		if *optListing != "" {
+			if err := writeListing(*optListing, asmState); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+
+		if *optBin {
+			for _, line := range binaryDump(comet2bin, comet2startAddress) {
+				fmt.Println(line)
+			}
+			os.Exit(0)
+		}
+
+		if *optJSON {
+			data, err := assemblyJSON(asmState, comet2bin, comet2startAddress)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			fmt.Println(string(data))
+			os.Exit(0)
+		}
+
+		if *optObject != "" {
+			if err := writeObject(*optObject, comet2bin, comet2startAddress); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if !*optRun {
+				os.Exit(0)
+			}
+		}
+
+		if *optCasl {
+			os.Exit(0)
+		}
 	}
 
-	// Assemble the code
-	asmState := newAssemblerState()
-	comet2bin, startLabel, err := assemble(inputFilepath, asmState)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	// Inputs from file follow the ones given on the command line
+	if *optInput != "" {
+		lines, err := readInputFile(*optInput)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		inputBuffer = append(inputBuffer, lines...)
 	}
 
-	caslPrint("Successfully assembled.")
+	// Initialize COMET2
+	loadMachine(comet2bin, comet2startAddress)
 
-	if *optCasl {
-		os.Exit(0)
+	if *optStack != "" {
+		top, ok := comet2.ExpandNumber(*optStack)
+		if !ok || top <= machine.AddressMax || top >= comet2.MEMORY_SIZE {
+			fmt.Fprintf(os.Stderr, "[COMET2 ERROR] Invalid stack top \"%s\": must be above the program (#%s)\n", *optStack, hex(machine.AddressMax, 4))
+			os.Exit(1)
+		}
+		machine.StackTop = top
 	}
 
-	// Initialize COMET2
-	comet2mem = make([]uint16, 0x10000) // Full 64K memory space
-	copy(comet2mem, comet2bin)
-	comet2startAddress = uint16(expandLabel(asmState.symtbl, startLabel))
+	if *optInLen <= 0 {
+		fmt.Fprintf(os.Stderr, "[COMET2 ERROR] Invalid input length %d\n", *optInLen)
+		os.Exit(1)
+	}
+	machine.InputLimit = *optInLen
 
-	state = []int{int(comet2startAddress), FR_PLUS, 0, 0, 0, 0, 0, 0, 0, 0, STACK_TOP}
+	if *optOutput != "" {
+		f, err := os.Create(*optOutput)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[COMET2 ERROR] Cannot create output file: %v\n", err)
+			os.Exit(1)
+		}
+		outFile = f
+		outWriter = bufio.NewWriter(f)
+	}
 
-	if !*optQuiet {
+	// Coverage maps addresses back to source lines, which objects lack
+	if *optCov {
+		if comet2asm == nil {
+			fmt.Fprintln(os.Stderr, "[COMET2 ERROR] -cov needs a source file, not an object file")
+			os.Exit(1)
+		}
+		coverage = make(map[int]bool)
+	}
+	if *optProfile {
+		profile = make(map[int]int)
+	}
+	// Only the source tells which words DS reserved
+	if *optSanitize && comet2asm == nil {
+		fmt.Fprintln(os.Stderr, "[COMET2 ERROR] -sanitize needs a source file, not an object file")
+		os.Exit(1)
+	}
+	if *optJumpChk && comet2asm == nil {
+		fmt.Fprintln(os.Stderr, "[COMET2 ERROR] -jumpcheck needs a source file, not an object file")
+		os.Exit(1)
+	}
+
+	initialInputs = inputBuffer
+	resetMachine(comet2mem, state)
+
+	if !*optQuiet && !*optNoBanner {
 		printGreen(`   __________  __  _______________   ________
   / ____/ __ \/  |/  / ____/_  __/  /  _/  _/
  / /   / / / / /|_/ / __/   / /     / / / /  
 / /___/ /_/ / /  / / /___  / /    _/ /_/ /   
 \____/\____/_/  /_/_____/ /_/    /___/___/  `)
 		fmt.Printf("This is COMET II, version %s.\n(c) 2001-2023, Osamu Mizuno.\n\n", VERSION)
+	}
+	if !*optQuiet {
 		cmdPrint(comet2mem, state, []string{})
 	}
 
@@ -259,8 +362,11 @@ func main() {
 	}
 
 	// Main loop
-	inputMode = INPUT_MODE_CMD
-	scanner := bufio.NewScanner(os.Stdin)
+	stdin = bufio.NewScanner(os.Stdin)
+	if sourceStdin {
+		// The source used up stdin; IN and the monitor only see EOF
+		stdin = bufio.NewScanner(strings.NewReader(""))
+	}
 
 	for {
 		var cmd string
@@ -271,10 +377,22 @@ func main() {
 				nextCmd = ""
 			} else {
 				fmt.Print(colorYellow("comet2") + "> ")
-				if !scanner.Scan() {
+				if !stdin.Scan() {
 					break
 				}
-				cmd = strings.TrimSpace(scanner.Text())
+				cmd = strings.TrimSpace(stdin.Text())
+				if strings.HasPrefix(cmd, "!") {
+					recalled, err := recallCommand(cmd[1:])
+					if err != nil {
+						fmt.Fprintln(os.Stderr, colorRedYellow(err.Error()))
+						continue
+					}
+					cmd = recalled
+					cometPrint(cmd)
+				}
+				if cmd != "" {
+					addHistory(cmd)
+				}
 			}
 
 			if cmd == "" {
@@ -298,40 +416,47 @@ func main() {
 
 			err := executeCommand(cmd2, args, comet2mem, state)
 			if err != nil {
-				if strings.Contains(err.Error(), "Program finished") ||
-					strings.Contains(err.Error(), "Stack overflow") ||
-					strings.Contains(err.Error(), "Stack underflow") {
-					fmt.Println(colorWhiteGreen(err.Error()))
-					break
+				var fault *comet2.Fault
+				isFault := errors.As(err, &fault)
+				if isFault || strings.Contains(err.Error(), "Program finished") {
+					exitStatus = 0
+					var exit *comet2.SVCExit
+					if isFault {
+						// Faults end the program abnormally
+						fmt.Fprintln(os.Stderr, colorRedYellow(err.Error()))
+						exitStatus = fault.Status
+					} else {
+						fmt.Println(colorWhiteGreen(err.Error()))
+						if errors.As(err, &exit) {
+							exitStatus = comet2.SVC_EXIT_STATUS + exit.Code
+						}
+					}
+					if !*optQuiet {
+						printStats()
+					}
+					// Stay in the monitor so that the program can be reset
+					if *optRun {
+						break
+					}
+					continue
 				}
 				fmt.Fprintln(os.Stderr, colorRedYellow(err.Error()))
 			}
 
 		} else if inputMode == INPUT_MODE_IN {
-			var input string
-			prompt := ""
-			if !*optQuietRun {
-				prompt = colorIGreen("IN") + "> "
-			}
+			inPC := state[comet2.PC]
+			machine.Input(inputSource())
+			inputMode = INPUT_MODE_CMD
+			stepJournal = nil
 
-			if len(inputBuffer) > 0 {
-				input = inputBuffer[0]
-				inputBuffer = inputBuffer[1:]
-				// Always print the input value when using buffered input
-				fmt.Printf("%s%s\n", prompt, input)
-			} else {
-				if prompt != "" {
-					fmt.Print(prompt)
-				}
-				if !scanner.Scan() {
-					break
-				}
-				input = scanner.Text()
+			// Without -eofempty, running out of input ends the program
+			// rather than letting it continue on a line that never came
+			if stdinEOF && !*optEOFEmpty {
+				fmt.Fprintln(os.Stderr, colorRedYellow(fmt.Sprintf("EOF on IN at #%s", hex(inPC, 4))))
+				exitStatus = 1
+				break
 			}
 
-			execIn(comet2mem, state, input)
-			inputMode = INPUT_MODE_CMD
-
 			if !*optQuiet {
 				if lastCmd == "s" || lastCmd == "step" {
 					cmdPrint(comet2mem, state, []string{})
@@ -339,6 +464,122 @@ func main() {
 			}
 		}
 	}
+
+	if coverage != nil {
+		for _, line := range coverageReport(comet2asm, coverage) {
+			cometPrint(line)
+		}
+	}
+
+	if profile != nil {
+		for _, line := range profileReport(comet2mem, profile, PROFILE_TOP) {
+			cometPrint(line)
+		}
+	}
+
+	closeOutput()
+	os.Exit(exitStatus)
+}
+
+// readInputFile returns the lines of an input file
+func readInputFile(path string) ([]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("[COMET2 ERROR] Cannot read input file: %v", err)
+	}
+	text := strings.ReplaceAll(string(content), "\r\n", "\n")
+	text = strings.TrimSuffix(text, "\n")
+	if text == "" {
+		return nil, nil
+	}
+	return strings.Split(text, "\n"), nil
+}
+
+// assembleInput assembles the source file at path; "-" reads the source
+// from standard input
+func assembleInput(path string, asmState *comet2.AssemblerState) ([]uint16, uint16, error) {
+	if path != "-" {
+		return comet2.AssembleFile(path, asmState)
+	}
+	content, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, 0, fmt.Errorf("[CASL2 ERROR] Cannot read standard input: %v", err)
+	}
+	return comet2.AssembleSource(string(content), STDIN_NAME, asmState)
+}
+
+// printAsmError prints an assembly error, one colored line per error
+// located in the source
+func printAsmError(err error) {
+	var asmErr *comet2.AsmError
+	if !errors.As(err, &asmErr) {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	for _, line := range strings.Split(err.Error(), "\n") {
+		fmt.Fprintln(os.Stderr, colorRedYellow(line))
+	}
+}
+
+// loadMachine makes the monitor's machine run image from start, with the
+// settings given on the command line
+func loadMachine(image []uint16, start uint16) {
+	machine = comet2.NewMachine(image, start)
+	if comet2asm != nil {
+		machine.AddressMax = comet2asm.AddressMax()
+	}
+	machine.Out = cometOut
+	machine.Warn = func(msg string) { fmt.Fprintln(os.Stderr, colorYellow(msg)) }
+	machine.OnWrite = journalWrite
+	machine.Strict = *optStrict
+	machine.DivContinue = *optDivCont
+	machine.StackWarn = *optStkWarn
+	comet2mem = machine.Memory()
+	state = machine.Registers()
+}
+
+// resetMachine restores memory, registers and inputs to their state at load time
+func resetMachine(memory []uint16, state []int) {
+	machine.Reset()
+	clearHistory()
+	machine.Uninitialized = nil
+	if *optSanitize && comet2asm != nil {
+		machine.Uninitialized = reservedWords(comet2asm)
+	}
+	if *optJumpChk && comet2asm != nil {
+		operandWords = operandAddresses(comet2asm)
+	}
+	runStepCount = 0
+	inputBuffer = append([]string(nil), initialInputs...)
+	inputMode = INPUT_MODE_CMD
+	nextCmd = ""
+	breakpointStop = -1
+	runTarget = -1
+	finishSP = -1
+	for i := range watchpoints {
+		watchpoints[i].lastVal = memGet(memory, watchpoints[i].addr)
+	}
+}
+
+// Utility functions
+func hex(val int, length int) string {
+	format := fmt.Sprintf("%%0%dx", length)
+	return fmt.Sprintf(format, val)
+}
+
+func signed(val int) int {
+	if val >= 32768 && val < 65536 {
+		val -= 65536
+	}
+	return val
+}
+
+// memGet returns the word at addr, or 0 outside memory
+func memGet(memory []uint16, addr int) int {
+	if addr < 0 || addr >= comet2.MEMORY_SIZE {
+		return 0
+	}
+	return int(memory[addr])
 }
 
 // Color functions
@@ -395,98 +636,64 @@ func cometPrint(msg string) {
 	fmt.Println(msg)
 }
 
-func cometOut(msg string) {
-	prefix := ""
+// cometIn reads the line for IN from the inputs given on the command line,
+// then from stdin
+func cometIn() string {
+	prompt := ""
 	if !*optQuietRun {
-		prefix = colorIRed("OUT") + "> "
+		prompt = colorIGreen("IN") + "> "
 	}
-	if !strings.HasSuffix(msg, "\n") {
-		msg += "\n"
-	}
-	fmt.Print(prefix + msg)
-}
-
-// Utility functions
-func hex(val int, length int) string {
-	format := fmt.Sprintf("%%0%dx", length)
-	return fmt.Sprintf(format, val)
-}
 
-func spacePadding(val, length int) string {
-	str := strconv.Itoa(val)
-	for len(str) < length {
-		str = " " + str
+	if len(inputBuffer) > 0 {
+		input := inputBuffer[0]
+		inputBuffer = inputBuffer[1:]
+		// Always print the input value when using buffered input
+		fmt.Printf("%s%s\n", prompt, input)
+		return input
 	}
-	return str
-}
 
-func signed(val int) int {
-	if val >= 32768 && val < 65536 {
-		val -= 65536
+	if prompt != "" {
+		fmt.Print(prompt)
 	}
-	return val
-}
-
-func unsigned(val int) int {
-	if val >= -32768 && val < 0 {
-		val += 65536
+	if !stdin.Scan() {
+		stdinEOF = true
+		return ""
 	}
-	return val
+	return stdin.Text()
 }
 
-func checkNumber(val string) bool {
-	if val == "" {
-		return false
+func cometOut(msg string) {
+	if !strings.HasSuffix(msg, "\n") {
+		msg += "\n"
 	}
-	if strings.HasPrefix(val, "#") {
-		_, err := strconv.ParseInt(val[1:], 16, 64)
-		return err == nil
+	if outWriter != nil {
+		outWriter.WriteString(msg)
+		return
 	}
-	_, err := strconv.ParseInt(val, 10, 64)
-	return err == nil
-}
 
-func expandNumber(val string) (int, bool) {
-	if !checkNumber(val) {
-		return 0, false
-	}
-	if strings.HasPrefix(val, "#") {
-		num, err := strconv.ParseInt(val[1:], 16, 64)
-		if err != nil {
-			return 0, false
-		}
-		// Safe: masked to 16 bits
-		return int(num & 0xffff), true
-	}
-	num, err := strconv.ParseInt(val, 10, 64)
-	if err != nil {
-		return 0, false
+	prefix := ""
+	if !*optQuietRun {
+		prefix = colorIRed("OUT") + "> "
 	}
-	// Safe: masked to 16 bits
-	return int(num & 0xffff), true
+	fmt.Print(prefix + msg)
 }
 
-func getFlag(val int) int {
-	if val&0x8000 != 0 {
-		return FR_MINUS
-	} else if val == 0 {
-		return FR_ZERO
-	} else {
-		return FR_PLUS
+// closeOutput flushes and closes the file given by -O
+func closeOutput() {
+	if outWriter == nil {
+		return
 	}
-}
-
-func memGet(memory []uint16, pc int) int {
-	if pc < 0 || pc >= len(memory) {
-		return 0
+	if err := outWriter.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "[COMET2 ERROR] Cannot write output file: %v\n", err)
 	}
-	return int(memory[pc])
+	outFile.Close()
+	outWriter = nil
 }
 
-func memPut(memory []uint16, pc int, val int) {
-	if pc < 0 || pc >= len(memory) {
-		return
+func spacePadding(val, length int) string {
+	str := strconv.Itoa(val)
+	for len(str) < length {
+		str = " " + str
 	}
-	
-	memory[pc] = uint16(val & 0xffff)
+	return str
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/f0reachARR/casljs/comet2"
+)
+
+// Object file layout (all values big-endian):
+//
+//	offset 0: magic "C2OB"
+//	offset 4: start address (16 bits)
+//	offset 6: number of words (32 bits)
+//	offset 10: words (16 bits each)
+const (
+	OBJECT_MAGIC       = "C2OB"
+	OBJECT_HEADER_SIZE = 10
+)
+
+// writeObject saves an assembled image and its start address to path
+func writeObject(path string, image []uint16, startAddress uint16) error {
+	data := make([]byte, OBJECT_HEADER_SIZE+len(image)*2)
+	copy(data, OBJECT_MAGIC)
+	binary.BigEndian.PutUint16(data[4:], startAddress)
+	binary.BigEndian.PutUint32(data[6:], uint32(len(image)))
+	for i, word := range image {
+		binary.BigEndian.PutUint16(data[OBJECT_HEADER_SIZE+i*2:], word)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("[CASL2 ERROR] Cannot write object file: %v", err)
+	}
+	return nil
+}
+
+// readObject loads an image and its start address from an object file
+func readObject(path string) ([]uint16, uint16, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("[COMET2 ERROR] Cannot read object file: %v", err)
+	}
+	if len(data) < OBJECT_HEADER_SIZE || string(data[:4]) != OBJECT_MAGIC {
+		return nil, 0, fmt.Errorf("[COMET2 ERROR] %s is not a COMET2 object file", path)
+	}
+
+	startAddress := binary.BigEndian.Uint16(data[4:])
+	length := int(binary.BigEndian.Uint32(data[6:]))
+	if length > comet2.MEMORY_SIZE || len(data) != OBJECT_HEADER_SIZE+length*2 {
+		return nil, 0, fmt.Errorf("[COMET2 ERROR] Object file %s is truncated or corrupt", path)
+	}
+
+	image := make([]uint16, length)
+	for i := range image {
+		image[i] = binary.BigEndian.Uint16(data[OBJECT_HEADER_SIZE+i*2:])
+	}
+	return image, startAddress, nil
+}
+
+// writeSymbolMap saves the symbol table to path, one "address scope label
+// line" entry per line in address order
+func writeSymbolMap(path string, asmState *comet2.AssemblerState) error {
+	var out strings.Builder
+	for _, sym := range asmState.Symbols() {
+		where := strconv.Itoa(sym.Line)
+		if sym.File != asmState.MainFile() {
+			where = sym.File + ":" + where
+		}
+		fmt.Fprintf(&out, "%s\t%s\t%s\t%s\n", hex(sym.Address, 4), sym.Scope, sym.Name, where)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(out.String()), 0644); err != nil {
+		return fmt.Errorf("[CASL2 ERROR] Cannot write map file: %v", err)
+	}
+	return nil
+}
+
+// binaryDump lists the start address and then the words of image in hex,
+// eight per line after their address
+func binaryDump(image []uint16, startAddress uint16) []string {
+	lines := []string{fmt.Sprintf("START #%s (%d words)", hex(int(startAddress), 4), len(image))}
+	for base := 0; base < len(image); base += 8 {
+		line := hex(base, 4) + ":"
+		for i := base; i < base+8 && i < len(image); i++ {
+			line += " " + hex(int(image[i]), 4)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// ansiEscapeRe matches the color sequences used for terminal output
+var ansiEscapeRe = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// writeListing saves the -a listing to path without color codes
+func writeListing(path string, asmState *comet2.AssemblerState) error {
+	var out strings.Builder
+	out.WriteString("CASL LISTING\n\n")
+	for _, line := range asmState.ListingLines() {
+		out.WriteString(ansiEscapeRe.ReplaceAllString(line, ""))
+		out.WriteString("\n")
+	}
+
+	if err := ioutil.WriteFile(path, []byte(out.String()), 0644); err != nil {
+		return fmt.Errorf("[CASL2 ERROR] Cannot write listing file: %v", err)
+	}
+	return nil
+}
+
+// SNAPSHOT_FORMAT identifies machine state files written by save
+const SNAPSHOT_FORMAT = "c2c2-snapshot-1"
+
+// Snapshot is the machine state saved by the monitor's save command
+type Snapshot struct {
+	Format           string   `json:"format"`
+	Memory           []uint16 `json:"memory"`
+	State            []int    `json:"state"`
+	InstructionCount int      `json:"instructionCount"`
+	CycleCount       int      `json:"cycleCount"`
+	Breakpoints      []int    `json:"breakpoints"`
+}
+
+// writeSnapshot saves memory, registers, statistics and breakpoints to path
+func writeSnapshot(path string, memory []uint16, state []int) error {
+	snapshot := Snapshot{
+		Format:           SNAPSHOT_FORMAT,
+		Memory:           memory,
+		State:            state,
+		InstructionCount: machine.Instructions,
+		CycleCount:       machine.Cycles,
+		Breakpoints:      []int{},
+	}
+	for addr := range breakpoints {
+		snapshot.Breakpoints = append(snapshot.Breakpoints, addr)
+	}
+	sort.Ints(snapshot.Breakpoints)
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("Cannot write snapshot: %v", err)
+	}
+	return nil
+}
+
+// readSnapshot restores a state saved by writeSnapshot into memory and state
+func readSnapshot(path string, memory []uint16, state []int) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Cannot read snapshot: %v", err)
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil || snapshot.Format != SNAPSHOT_FORMAT {
+		return fmt.Errorf("%s is not a COMET2 snapshot", path)
+	}
+	if len(snapshot.Memory) != len(memory) || len(snapshot.State) != len(state) {
+		return fmt.Errorf("Snapshot %s does not match this machine", path)
+	}
+
+	copy(memory, snapshot.Memory)
+	copy(state, snapshot.State)
+	machine.Instructions = snapshot.InstructionCount
+	machine.Cycles = snapshot.CycleCount
+	breakpoints = make(map[int]bool)
+	for _, addr := range snapshot.Breakpoints {
+		breakpoints[addr] = true
+	}
+	breakpointStop = -1
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestObjectRoundTrip(t *testing.T) {
+	src := `MAIN	START	BEGIN
+DATA	DC	1, 2, 3
+BEGIN	LD	GR1, DATA
+	RET
+	END
+`
+	bin, start, _, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "test.obj")
+	if err := writeObject(path, bin, start); err != nil {
+		t.Fatalf("writeObject failed: %v", err)
+	}
+
+	image, loadedStart, err := readObject(path)
+	if err != nil {
+		t.Fatalf("readObject failed: %v", err)
+	}
+	if loadedStart != 3 {
+		t.Errorf("start address = #%s, want #0003", hex(int(loadedStart), 4))
+	}
+	if len(image) != len(bin) {
+		t.Fatalf("len(image) = %d, want %d", len(image), len(bin))
+	}
+	for i := range bin {
+		if image[i] != bin[i] {
+			t.Errorf("word %d = #%s, want #%s", i, hex(int(image[i]), 4), hex(int(bin[i]), 4))
+		}
+	}
+}
+
+func TestSymbolMap(t *testing.T) {
+	src := `MAIN	START	BEGIN
+DATA	DC	1, 2, 3
+BEGIN	LD	GR1, =5
+	RET
+	END
+`
+	_, _, asmState, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "test.map")
+	if err := writeSymbolMap(path, asmState); err != nil {
+		t.Fatalf("writeSymbolMap failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if !strings.Contains(string(data), "0003\tMAIN\tBEGIN\t3\n") {
+		t.Errorf("BEGIN entry missing from map:\n%s", data)
+	}
+	// MAIN, DATA and BEGIN; the literal is left out
+	if len(lines) != 3 {
+		t.Errorf("map has %d entries, want 3:\n%s", len(lines), data)
+	}
+}
+
+func TestBinaryDump(t *testing.T) {
+	src := `MAIN	START	BEGIN
+DATA	DC	1, 2, 3, 4, 5, 6, 7
+BEGIN	LD	GR1, DATA
+	RET
+	END
+`
+	bin, start, _, err := assembleSource(t, src)
+	if err != nil {
+		t.Fatalf("assemble failed: %v", err)
+	}
+	lines := binaryDump(bin, start)
+
+	want := []string{
+		"START #0007 (10 words)",
+		"0000: 0001 0002 0003 0004 0005 0006 0007 1010",
+		"0008: 0000 8100",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("binaryDump = %q, want %q", lines, want)
+	}
+}